@@ -0,0 +1,53 @@
+package s3
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"triple-s/internal/storage"
+)
+
+var fsckHelpMessage = `
+Checks the metadata of the data directory against the stored files. Stop the server first.
+
+**Usage:**
+    triple-s fsck [-dir <S>] [-repair]
+
+**Options:**
+- --dir S     Path to the directory
+- --repair    Fix the inconsistencies by rebuilding the metadata from the files
+`
+
+// Fsck implements the fsck subcommand which reports (and optionally repairs)
+// every inconsistency between the metadata and the bucket directories
+func Fsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	flags.Usage = func() { fmt.Println(fsckHelpMessage) }
+	dirPtr := flags.String("dir", "data", "path to the directory where the files are stored")
+	repairPtr := flags.Bool("repair", false, "fix the inconsistencies which are found")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	issues, err := storage.Fsck(*dirPtr, *repairPtr)
+	unrepaired := 0
+	for _, issue := range issues {
+		fmt.Println(issue)
+		if !issue.Repaired {
+			unrepaired++
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to check %s: %v\n", *dirPtr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d inconsistencies found, %d repaired\n", len(issues), len(issues)-unrepaired)
+	if unrepaired > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,76 @@
+package s3
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"triple-s/internal"
+)
+
+var presignHelpMessage = `
+Generates a presigned URL to download or upload an object.
+
+**Usage:**
+    triple-s presign [-dir <S>] [-endpoint <URL>] [-method GET|PUT] [-expires <D>] [-access-key <K>] [-region <R>] <BucketName> <ObjectKey>
+
+**Options:**
+- --dir S          Path to the directory holding credentials.csv
+- --endpoint URL   Address of the server the URL points to
+- --method M       GET to download or PUT to upload the object
+- --expires D      How long the URL is valid, e.g. 15m or 24h (at most 168h)
+- --access-key K   Access key to sign with, required if credentials.csv has several
+- --region R       Region of the credential scope
+`
+
+// Presign implements the presign subcommand which prints a presigned URL for an object
+func Presign(args []string) {
+	flags := flag.NewFlagSet("presign", flag.ExitOnError)
+	flags.Usage = func() { fmt.Println(presignHelpMessage) }
+	dirPtr := flags.String("dir", "data", "path to the directory where credentials.csv is stored")
+	endpointPtr := flags.String("endpoint", "http://localhost:6666", "address of the server")
+	methodPtr := flags.String("method", http.MethodGet, "GET to download or PUT to upload the object")
+	expiresPtr := flags.Duration("expires", time.Hour, "how long the URL is valid")
+	accessKeyPtr := flags.String("access-key", "", "access key to sign with")
+	regionPtr := flags.String("region", "us-east-1", "region of the credential scope")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Bucket name and object key are required\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	method := strings.ToUpper(*methodPtr)
+	if method != http.MethodGet && method != http.MethodPut {
+		fmt.Fprintf(os.Stderr, "Method must be GET or PUT\n")
+		os.Exit(1)
+	}
+
+	credentials, err := internal.LoadCredentials(*dirPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load credentials: %v\n", err)
+		os.Exit(1)
+	}
+
+	accessKey := *accessKeyPtr
+	if accessKey == "" && len(credentials) == 1 {
+		for key := range credentials {
+			accessKey = key
+		}
+	}
+	secretKey, found := credentials[accessKey]
+	if !found {
+		fmt.Fprintf(os.Stderr, "No such access key in %s/credentials.csv, use -access-key to choose one\n", *dirPtr)
+		os.Exit(1)
+	}
+
+	presignedURL, err := internal.PresignURL(*endpointPtr, method, flags.Arg(0), flags.Arg(1), accessKey, secretKey, *regionPtr, *expiresPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to presign the URL: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(presignedURL)
+}
@@ -6,26 +6,41 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"triple-s/internal"
+	"triple-s/internal/storage"
+	"triple-s/utils"
 )
 
 var helpMessage = `
 Simple Storage Service.
 
 **Usage:**
-    triple-s [-port <N>] [-dir <S>]
+    triple-s [-port <N>] [-dir <S>] [-storage fs|memory] [-master-key <S>] [-dedup] [-lifecycle-interval <D>] [-max-object-size <N>]
+    triple-s presign [-dir <S>] [-method GET|PUT] [-expires <D>] <BucketName> <ObjectKey>
+    triple-s fsck [-dir <S>] [-repair]
     triple-s --help
 
 	**Options:**
 - --help     Show this screen.
 - --port N   Port number
 - --dir S    Path to the directory
+- --storage  Storage backend: fs keeps the data in the directory, memory until the server stops
+- --master-key S  File with the SSE-S3 master key, best kept outside <dir>, generated if missing while no object is encrypted with it (default <dir>/.metadata/master.key)
+- --dedup   Store identical object contents once, shared by reference
+- --lifecycle-interval D  How often the lifecycle rules of the buckets are applied, e.g. 10m (default 1h)
+- --max-object-size N  Largest object accepted in bytes, 0 for no limit (default 5 GiB)
 `
 
 func Run() {
 	dirPtr := flag.String("dir", "data", "path to the directory where the files will be stored")
 	portPtr := flag.String("port", "6666", "port value that the server will use")
+	storagePtr := flag.String("storage", "fs", "storage backend: fs or memory")
+	masterKeyPtr := flag.String("master-key", "", "file with the master key of server-side encryption, best kept outside <dir>, <dir>/.metadata/master.key by default")
+	dedupPtr := flag.Bool("dedup", false, "store identical object contents once in a shared blob store")
+	lifecycleIntervalPtr := flag.Duration("lifecycle-interval", time.Hour, "how often the lifecycle rules of the buckets are applied")
+	maxObjectSizePtr := flag.Int64("max-object-size", 5<<30, "largest object accepted in bytes, 0 for no limit")
 	helpPtr := flag.Bool("help", false, "shows the usage information")
 
 	flag.Parse()
@@ -39,44 +54,155 @@ func Run() {
 		return
 	}
 
+	if *lifecycleIntervalPtr <= 0 {
+		fmt.Fprintf(os.Stderr, "Lifecycle interval must be positive\n")
+		return
+	}
+	if *maxObjectSizePtr < 0 {
+		fmt.Fprintf(os.Stderr, "Max object size must not be negative\n")
+		return
+	}
+
 	router := http.NewServeMux()
 
-	err := os.MkdirAll(*dirPtr, 0o755)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create directory:", err)
+	// the file storage keeps its metadata between restarts and reconciles it with the bucket directories
+	var store storage.Storage
+	switch *storagePtr {
+	case "fs":
+		fileStore, err := storage.NewFileStorage(*dirPtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open the storage: %v\n", err)
+			return
+		}
+		// SSE-S3 wraps the keys of the objects with the master key, losing it loses those objects,
+		// so that the server does not start without it once objects are encrypted with it
+		masterKeyPath := *masterKeyPtr
+		if masterKeyPath == "" {
+			masterKeyPath = *dirPtr + "/.metadata/master.key"
+		}
+		err = fileStore.LoadMasterKey(masterKeyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load the master key: %v\n", err)
+			return
+		}
+		if *dedupPtr {
+			fileStore.EnableDeduplication()
+		}
+		fileStore.SetMaxObjectSize(*maxObjectSizePtr)
+		store = fileStore
+	case "memory":
+		memoryStore := storage.NewMemoryStorage()
+		memoryStore.SetMaxObjectSize(*maxObjectSizePtr)
+		store = memoryStore
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown storage backend: %s\n", *storagePtr)
 		return
 	}
 
-	csvPath := *dirPtr + "/buckets.csv"
-	file, err := os.Create(csvPath)
+	// requests have to be signed with one of the access keys of credentials.csv when it exists
+	credentials, err := internal.LoadCredentials(*dirPtr)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create buckets.csv:", err)
+		fmt.Fprintf(os.Stderr, "Failed to load credentials: %v\n", err)
 		return
 	}
-	defer file.Close()
+	if len(credentials) == 0 {
+		fmt.Println("No credentials.csv found: authentication is disabled")
+	}
 
+	// bucket subresources such as ?versioning or ?compression are told apart by their query
 	router.HandleFunc("PUT /{BucketName}", func(w http.ResponseWriter, r *http.Request) {
-		internal.CreateBuckets(w, r, *dirPtr)
+		if r.URL.Query().Has("versioning") {
+			internal.PutBucketVersioning(w, r, store)
+		} else if r.URL.Query().Has("compression") {
+			internal.PutBucketCompression(w, r, store)
+		} else if r.URL.Query().Has("lifecycle") {
+			internal.PutBucketLifecycle(w, r, store)
+		} else if r.URL.Query().Has("quota") {
+			internal.PutBucketQuota(w, r, store)
+		} else {
+			internal.CreateBuckets(w, r, store)
+		}
 	})
 	router.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
-		internal.GetBuckets(w, r, *dirPtr)
+		internal.GetBuckets(w, r, store)
+	})
+	router.HandleFunc("GET /{BucketName}", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("versioning") {
+			internal.GetBucketVersioning(w, r, store)
+		} else if r.URL.Query().Has("versions") {
+			internal.ListObjectVersions(w, r, store)
+		} else if r.URL.Query().Has("compression") {
+			internal.GetBucketCompression(w, r, store)
+		} else if r.URL.Query().Has("usage") {
+			internal.GetBucketUsage(w, r, store)
+		} else if r.URL.Query().Has("lifecycle") {
+			internal.GetBucketLifecycle(w, r, store)
+		} else if r.URL.Query().Has("quota") {
+			internal.GetBucketQuota(w, r, store)
+		} else {
+			internal.ListObjects(w, r, store)
+		}
+	})
+	router.HandleFunc("HEAD /{BucketName}", func(w http.ResponseWriter, r *http.Request) {
+		internal.HeadBucket(w, r, store)
+	})
+	router.HandleFunc("POST /{BucketName}", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("delete") {
+			internal.DeleteMultipleObjects(w, r, store)
+		} else {
+			utils.DisplayErrorWoErr(w, utils.ErrMethodNotAllowed, "")
+		}
 	})
 	router.HandleFunc("DELETE /{BucketName}", func(w http.ResponseWriter, r *http.Request) {
-		internal.DeleteBuckets(w, r, *dirPtr)
+		if r.URL.Query().Has("lifecycle") {
+			internal.DeleteBucketLifecycle(w, r, store)
+		} else {
+			internal.DeleteBuckets(w, r, store)
+		}
 	})
 
-	router.HandleFunc("PUT /{BucketName}/{ObjectKey}", func(w http.ResponseWriter, r *http.Request) {
-		internal.CreateObjects(w, r, *dirPtr)
+	// multipart upload and copy requests share the object routes and are told apart by their query or headers
+	router.HandleFunc("PUT /{BucketName}/{ObjectKey...}", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("uploadId") {
+			internal.UploadPart(w, r, store)
+		} else if r.Header.Get("x-amz-copy-source") != "" {
+			internal.CopyObject(w, r, store)
+		} else {
+			internal.CreateObjects(w, r, store)
+		}
 	})
-	router.HandleFunc("GET /{BucketName}/{ObjectKey}", func(w http.ResponseWriter, r *http.Request) {
-		internal.GetObjects(w, r, *dirPtr)
+	router.HandleFunc("POST /{BucketName}/{ObjectKey...}", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("uploads") {
+			internal.CreateMultipartUpload(w, r, store)
+		} else if r.URL.Query().Has("uploadId") {
+			internal.CompleteMultipartUpload(w, r, store)
+		} else {
+			utils.DisplayErrorWoErr(w, utils.ErrMethodNotAllowed, "")
+		}
 	})
-	router.HandleFunc("DELETE /{BucketName}/{ObjectKey}", func(w http.ResponseWriter, r *http.Request) {
-		internal.DeleteObjects(w, r, *dirPtr)
+	router.HandleFunc("GET /{BucketName}/{ObjectKey...}", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("uploadId") {
+			internal.ListParts(w, r, store)
+		} else {
+			internal.GetObjects(w, r, store)
+		}
 	})
+	router.HandleFunc("HEAD /{BucketName}/{ObjectKey...}", func(w http.ResponseWriter, r *http.Request) {
+		internal.HeadObject(w, r, store)
+	})
+	router.HandleFunc("DELETE /{BucketName}/{ObjectKey...}", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("uploadId") {
+			internal.AbortMultipartUpload(w, r, store)
+		} else {
+			internal.DeleteObjects(w, r, store)
+		}
+	})
+
+	// expired objects are deleted in the background while the server runs
+	go internal.ExpireObjects(store, *lifecycleIntervalPtr)
 
 	fmt.Println("Server is listening to: " + *portPtr)
-	err = http.ListenAndServe(":"+*portPtr, router)
+	err = http.ListenAndServe(":"+*portPtr, utils.WithRequestID(internal.WithAuthentication(credentials, router)))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error starting server: %v\n", err)
 	}
@@ -0,0 +1,445 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"triple-s/utils"
+)
+
+const (
+	signV4Algorithm          = "AWS4-HMAC-SHA256"
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	amzDateFormat            = "20060102T150405Z"
+	maxClockSkew             = 15 * time.Minute
+	maxPresignExpiry         = 7 * 24 * time.Hour
+)
+
+// Credentials maps access key ids to their secret access keys
+type Credentials map[string]string
+
+// signature holds the parts of a SigV4 signature sent either
+// in the Authorization header or in the presigned URL query
+type signature struct {
+	accessKey     string
+	scopeDate     string
+	region        string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	requestTime   time.Time
+}
+
+func (s signature) scope() string {
+	return s.scopeDate + "/" + s.region + "/s3/aws4_request"
+}
+
+// LoadCredentials reads the access keys from <dir>/credentials.csv, one
+// "access key id,secret access key" pair per row. Without the file
+// no credentials are returned and authentication stays disabled
+func LoadCredentials(dir string) (Credentials, error) {
+	credentialsCsv, err := os.Open(dir + "/credentials.csv")
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer credentialsCsv.Close()
+
+	csvReader := csv.NewReader(credentialsCsv)
+	csvReader.FieldsPerRecord = -1
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := make(Credentials)
+	for i, record := range records {
+		if len(record) < 2 || record[0] == "" || record[1] == "" {
+			return nil, fmt.Errorf("credentials.csv line %d: expected an access key id and a secret access key", i+1)
+		}
+		credentials[record[0]] = record[1]
+	}
+	return credentials, nil
+}
+
+// WithAuthentication only lets requests signed with AWS Signature Version 4
+// by one of the credentials through to next. Without credentials every request passes
+func WithAuthentication(credentials Credentials, next http.Handler) http.Handler {
+	if len(credentials) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if authenticateRequest(w, req, credentials) {
+			next.ServeHTTP(w, req)
+		}
+	})
+}
+
+// authenticateRequest verifies the signature of a request, displaying an error if it is not valid.
+// The body of a request with a signed payload is wrapped so that it is verified while being read
+func authenticateRequest(w http.ResponseWriter, req *http.Request, credentials Credentials) bool {
+	var sig signature
+	var payloadHash string
+	var apiError utils.APIError
+	var message string
+
+	if authorization := req.Header.Get("Authorization"); authorization != "" {
+		sig, apiError, message = parseAuthorizationHeader(req, authorization)
+		payloadHash = req.Header.Get("X-Amz-Content-Sha256")
+		if apiError.Code == "" && payloadHash == "" {
+			apiError, message = utils.ErrInvalidRequest, "Missing required header for this request: x-amz-content-sha256"
+		}
+	} else if req.URL.Query().Has("X-Amz-Signature") {
+		if !presignAllowed(req) {
+			utils.DisplayErrorWoErr(w, utils.ErrAccessDenied, "Presigned URLs are only accepted to download or upload an object")
+			return false
+		}
+		sig, apiError, message = parsePresignedQuery(req)
+		payloadHash = unsignedPayload
+		if hash := req.URL.Query().Get("X-Amz-Content-Sha256"); hash != "" {
+			payloadHash = hash
+		}
+	} else {
+		apiError, message = utils.ErrAccessDenied, "Anonymous access is not allowed"
+	}
+	if name := unsignedAmzHeader(req, sig.signedHeaders); apiError.Code == "" && name != "" {
+		apiError, message = utils.ErrAccessDenied, "There were headers present in the request which were not signed: "+name
+	}
+	if apiError.Code != "" {
+		utils.DisplayErrorWoErr(w, apiError, message)
+		return false
+	}
+
+	secretKey, found := credentials[sig.accessKey]
+	if !found {
+		utils.DisplayErrorWoErr(w, utils.ErrInvalidAccessKeyId, "")
+		return false
+	}
+
+	key := signingKey(secretKey, sig.scopeDate, sig.region)
+	canonical := canonicalRequest(req, sig.signedHeaders, payloadHash)
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign(sig, canonical)))
+	if !hmac.Equal([]byte(expected), []byte(sig.signature)) {
+		utils.DisplayErrorWoErr(w, utils.ErrSignatureDoesNotMatch, "")
+		return false
+	}
+
+	// the signature covers the hash of the payload, which is only known once the body is read
+	switch payloadHash {
+	case unsignedPayload:
+	case streamingPayload, streamingPayloadTrailer, streamingUnsignedTrailer:
+		req.Body = newChunkedReader(req.Body, key, sig, payloadHash != streamingUnsignedTrailer, payloadHash != streamingPayload)
+		req.ContentLength = -1
+		if decodedLength, err := strconv.ParseInt(req.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+			req.ContentLength = decodedLength
+		}
+		removeAwsChunkedEncoding(req)
+	default:
+		if len(payloadHash) != sha256.Size*2 {
+			utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, "x-amz-content-sha256 must be UNSIGNED-PAYLOAD, STREAMING-* or a hex encoded SHA-256")
+			return false
+		}
+		req.Body = &payloadHashReader{body: req.Body, hash: sha256.New(), expected: strings.ToLower(payloadHash)}
+	}
+
+	return true
+}
+
+func parseAuthorizationHeader(req *http.Request, authorization string) (signature, utils.APIError, string) {
+	var sig signature
+	algorithm, fields, found := strings.Cut(authorization, " ")
+	if !found || algorithm != signV4Algorithm {
+		return sig, utils.ErrInvalidRequest, "Please use " + signV4Algorithm + " to authenticate"
+	}
+
+	params := make(map[string]string)
+	for _, field := range strings.Split(fields, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		params[name] = value
+	}
+
+	var ok bool
+	sig, ok = parseCredential(params["Credential"])
+	if !ok || params["SignedHeaders"] == "" || params["Signature"] == "" {
+		return sig, utils.ErrAuthorizationHeaderMalformed, ""
+	}
+	sig.signedHeaders = strings.Split(params["SignedHeaders"], ";")
+	sig.signature = params["Signature"]
+
+	// X-Amz-Date takes precedence over the standard Date header
+	sig.amzDate = req.Header.Get("X-Amz-Date")
+	if sig.amzDate != "" {
+		requestTime, err := time.Parse(amzDateFormat, sig.amzDate)
+		if err != nil {
+			return sig, utils.ErrAccessDenied, "X-Amz-Date must be in the ISO8601 basic format"
+		}
+		sig.requestTime = requestTime
+	} else {
+		requestTime, err := http.ParseTime(req.Header.Get("Date"))
+		if err != nil {
+			return sig, utils.ErrAccessDenied, "AWS authentication requires a valid Date or x-amz-date header"
+		}
+		sig.requestTime = requestTime.UTC()
+		sig.amzDate = sig.requestTime.Format(amzDateFormat)
+	}
+
+	if !strings.HasPrefix(sig.amzDate, sig.scopeDate) {
+		return sig, utils.ErrAuthorizationHeaderMalformed, "The credential scope date does not match the request date"
+	}
+	if skew := time.Since(sig.requestTime); skew > maxClockSkew || skew < -maxClockSkew {
+		return sig, utils.ErrRequestTimeTooSkewed, ""
+	}
+	if !containsHost(sig.signedHeaders) {
+		return sig, utils.ErrAuthorizationHeaderMalformed, "The host header must be signed"
+	}
+
+	return sig, utils.APIError{}, ""
+}
+
+func parsePresignedQuery(req *http.Request) (signature, utils.APIError, string) {
+	query := req.URL.Query()
+	if query.Get("X-Amz-Algorithm") != signV4Algorithm {
+		return signature{}, utils.ErrAuthorizationQueryParametersError, "X-Amz-Algorithm only supports " + signV4Algorithm
+	}
+
+	sig, ok := parseCredential(query.Get("X-Amz-Credential"))
+	if !ok {
+		return sig, utils.ErrAuthorizationQueryParametersError, "Error parsing the X-Amz-Credential parameter"
+	}
+	sig.signature = query.Get("X-Amz-Signature")
+	sig.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	if !containsHost(sig.signedHeaders) {
+		return sig, utils.ErrAuthorizationQueryParametersError, "The host header must be signed"
+	}
+
+	sig.amzDate = query.Get("X-Amz-Date")
+	requestTime, err := time.Parse(amzDateFormat, sig.amzDate)
+	if err != nil || !strings.HasPrefix(sig.amzDate, sig.scopeDate) {
+		return sig, utils.ErrAuthorizationQueryParametersError, "X-Amz-Date must be in the ISO8601 basic format and match the credential scope"
+	}
+	sig.requestTime = requestTime
+
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 1 || time.Duration(expires)*time.Second > maxPresignExpiry {
+		return sig, utils.ErrAuthorizationQueryParametersError, "X-Amz-Expires must be between 1 and 604800 seconds"
+	}
+	if time.Until(requestTime) > maxClockSkew {
+		return sig, utils.ErrAccessDenied, "Request is not valid yet"
+	}
+	if time.Since(requestTime) > time.Duration(expires)*time.Second {
+		return sig, utils.ErrAccessDenied, "Request has expired"
+	}
+
+	return sig, utils.APIError{}, ""
+}
+
+// presignAllowed reports whether a request may be authenticated by a presigned URL,
+// which only grants GetObjects (and HEAD) and CreateObjects on a single object: a PUT
+// naming a copy source would read another object, so copies are refused even when signed
+func presignAllowed(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && req.Method != http.MethodPut {
+		return false
+	}
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-copy-source") || name == "x-amz-metadata-directive" {
+			return false
+		}
+	}
+	query := req.URL.Query()
+	if query.Has("uploadId") || query.Has("uploads") {
+		return false
+	}
+	_, objectKey, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	return objectKey != ""
+}
+
+// PresignURL returns a URL of endpoint granting method on the object for expires from now,
+// signed with the secret key of accessKey the same way the AWS SDKs presign requests
+func PresignURL(endpoint, method, bucketName, objectKey, accessKey, secretKey, region string, expires time.Duration) (string, error) {
+	if expires < time.Second || expires > maxPresignExpiry {
+		return "", errors.New("the expiry must be between 1 second and 7 days")
+	}
+	presignURL, err := url.Parse(endpoint)
+	if err != nil || presignURL.Host == "" {
+		return "", fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+
+	now := time.Now().UTC()
+	sig := signature{
+		accessKey:     accessKey,
+		scopeDate:     now.Format("20060102"),
+		region:        region,
+		signedHeaders: []string{"host"},
+		amzDate:       now.Format(amzDateFormat),
+	}
+
+	presignURL.Path = "/" + bucketName + "/" + objectKey
+	presignURL.RawPath = uriEncode(presignURL.Path, false)
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", signV4Algorithm)
+	query.Set("X-Amz-Credential", accessKey+"/"+sig.scope())
+	query.Set("X-Amz-Date", sig.amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	presignURL.RawQuery = query.Encode()
+
+	req := &http.Request{Method: method, URL: presignURL, Host: presignURL.Host, Header: http.Header{}}
+	key := signingKey(secretKey, sig.scopeDate, sig.region)
+	sig.signature = hex.EncodeToString(hmacSHA256(key, stringToSign(sig, canonicalRequest(req, sig.signedHeaders, unsignedPayload))))
+
+	presignURL.RawQuery = canonicalQuery(req) + "&X-Amz-Signature=" + sig.signature
+	return presignURL.String(), nil
+}
+
+// parseCredential parses <access key>/<date>/<region>/s3/aws4_request
+func parseCredential(credential string) (signature, bool) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[0] == "" || len(parts[1]) != 8 || parts[3] != "s3" || parts[4] != "aws4_request" {
+		return signature{}, false
+	}
+	return signature{accessKey: parts[0], scopeDate: parts[1], region: parts[2]}, true
+}
+
+// unsignedAmzHeader returns the first x-amz-* header of a request missing from signedHeaders:
+// each of them changes what the request does, so none may be added or altered in transit
+func unsignedAmzHeader(req *http.Request, signedHeaders []string) string {
+	var unsigned []string
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") && !slices.Contains(signedHeaders, name) {
+			unsigned = append(unsigned, name)
+		}
+	}
+	sort.Strings(unsigned)
+	if len(unsigned) == 0 {
+		return ""
+	}
+	return unsigned[0]
+}
+
+func containsHost(signedHeaders []string) bool {
+	for _, header := range signedHeaders {
+		if header == "host" {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalRequest builds the canonical form of a request that is hashed into the string to sign
+func canonicalRequest(req *http.Request, signedHeaders []string, payloadHash string) string {
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		var values []string
+		switch name {
+		case "host":
+			values = []string{req.Host}
+		case "content-length":
+			values = req.Header.Values(name)
+			if len(values) == 0 && req.ContentLength >= 0 {
+				values = []string{strconv.FormatInt(req.ContentLength, 10)}
+			}
+		default:
+			values = req.Header.Values(name)
+		}
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.Join(trimmed, ",") + "\n")
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// canonicalQuery sorts and encodes the query parameters, leaving out the signature itself
+func canonicalQuery(req *http.Request) string {
+	var pairs []string
+	for name, values := range req.URL.Query() {
+		if name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func stringToSign(sig signature, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	return signV4Algorithm + "\n" + sig.amzDate + "\n" + sig.scope() + "\n" + hex.EncodeToString(hash[:])
+}
+
+func signingKey(secretKey, date, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode percent-encodes everything but the unreserved characters the way SigV4 expects
+func uriEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !encodeSlash) {
+			encoded.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", ch)
+		}
+	}
+	return encoded.String()
+}
+
+func removeAwsChunkedEncoding(req *http.Request) {
+	var encodings []string
+	for _, encoding := range strings.Split(req.Header.Get("Content-Encoding"), ",") {
+		if encoding = strings.TrimSpace(encoding); encoding != "" && encoding != "aws-chunked" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	if len(encodings) == 0 {
+		req.Header.Del("Content-Encoding")
+	} else {
+		req.Header.Set("Content-Encoding", strings.Join(encodings, ","))
+	}
+}
+
+var (
+	errContentSHA256Mismatch = errors.New("the provided x-amz-content-sha256 does not match the payload")
+	errChunkSignature        = errors.New("the chunk signature does not match")
+	errUnexpectedTrailer     = errors.New("the body has trailers the payload does not declare or which are malformed")
+)
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+
+	"triple-s/internal/storage"
+	"triple-s/utils"
+)
+
+// CompressionConfiguration sets the algorithm the objects written to a bucket are stored
+// compressed with, gzip or flate, an empty one stores them as they are
+type CompressionConfiguration struct {
+	XMLName   xml.Name `xml:"CompressionConfiguration"`
+	Xmlns     string   `xml:"xmlns,attr,omitempty"`
+	Algorithm string   `xml:",omitempty"`
+}
+
+// BucketUsageResult reports the usage of a bucket next to the limits of its quota, if it has one
+type BucketUsageResult struct {
+	XMLName     xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ BucketUsage"`
+	Bucket      string
+	ObjectCount int64
+	Size        int64
+	StoredSize  int64
+	UploadSize  int64
+	MaxSize     int64 `xml:",omitempty"`
+	MaxObjects  int64 `xml:",omitempty"`
+}
+
+func PutBucketCompression(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+
+	compressionStore, ok := store.(storage.CompressionStorage)
+	if !ok {
+		utils.DisplayErrorWoErr(w, utils.ErrNotImplemented, "Compression is not supported by the storage")
+		return
+	}
+	if _, err := store.StatBucket(bucketName); err != nil {
+		displayStorageError(w, err, "Failed to read the bucket: ")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxConfigurationSize))
+	if err != nil {
+		displayStorageError(w, err, "Failed to read the request body: ")
+		return
+	}
+
+	var configuration CompressionConfiguration
+	err = xml.Unmarshal(body, &configuration)
+	algorithm := configuration.Algorithm
+	if err != nil || (algorithm != "" && algorithm != storage.CompressionGzip && algorithm != storage.CompressionFlate) {
+		utils.DisplayErrorWoErr(w, utils.ErrMalformedXML, "")
+		return
+	}
+
+	err = compressionStore.SetCompression(bucketName, algorithm)
+	if err != nil {
+		displayStorageError(w, err, "Failed to set the compression: ")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetBucketCompression(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+
+	bucket, err := store.StatBucket(bucketName)
+	if err != nil {
+		displayStorageError(w, err, "Failed to read the bucket: ")
+		return
+	}
+
+	utils.DisplayXML(w, http.StatusOK, CompressionConfiguration{
+		Xmlns:     "http://s3.amazonaws.com/doc/2006-03-01/",
+		Algorithm: bucket.Compression,
+	})
+}
+
+// GetBucketUsage reports the number of object versions of a bucket, the size of their
+// contents, the space they take in the storage and that of the parts of the multipart
+// uploads in progress, which its quota is checked against
+func GetBucketUsage(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+
+	usageStore, ok := store.(storage.UsageStorage)
+	if !ok {
+		utils.DisplayErrorWoErr(w, utils.ErrNotImplemented, "Usage reporting is not supported by the storage")
+		return
+	}
+	bucket, err := store.StatBucket(bucketName)
+	if err != nil {
+		displayStorageError(w, err, "Failed to read the bucket: ")
+		return
+	}
+	usage, err := usageStore.BucketUsage(bucketName)
+	if err != nil {
+		displayStorageError(w, err, "Failed to read the bucket usage: ")
+		return
+	}
+
+	utils.DisplayXML(w, http.StatusOK, BucketUsageResult{
+		Bucket:      bucketName,
+		ObjectCount: usage.Objects,
+		Size:        usage.Size,
+		StoredSize:  usage.StoredSize,
+		UploadSize:  usage.UploadSize,
+		MaxSize:     bucket.Quota.MaxSize,
+		MaxObjects:  bucket.Quota.MaxObjects,
+	})
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"triple-s/internal/storage"
+	"triple-s/utils"
+)
+
+// checkPreconditions evaluates the conditional request headers against the object
+// described by info. If the request must not be served it writes the
+// 304 Not Modified or 412 Precondition Failed response and returns false
+func checkPreconditions(w http.ResponseWriter, req *http.Request, info storage.ObjectInfo) bool {
+	eTag := objectETag(info)
+	lastModified := info.LastModified
+
+	// If-Unmodified-Since is only evaluated without If-Match
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		if !eTagMatches(ifMatch, eTag) {
+			preconditionFailed(w)
+			return false
+		}
+	} else if since, err := http.ParseTime(req.Header.Get("If-Unmodified-Since")); err == nil {
+		if lastModified.Truncate(time.Second).After(since) {
+			preconditionFailed(w)
+			return false
+		}
+	}
+
+	// If-Modified-Since is only evaluated without If-None-Match
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if eTagMatches(ifNoneMatch, eTag) {
+			notModified(w, info)
+			return false
+		}
+	} else if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil {
+		if !lastModified.Truncate(time.Second).After(since) {
+			notModified(w, info)
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkIfRange reports whether the Range header should be honoured,
+// which is the case when If-Range is absent or still matches the object
+func checkIfRange(req *http.Request, info storage.ObjectInfo) bool {
+	ifRange := req.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == objectETag(info)
+	}
+
+	since, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	return info.LastModified.Truncate(time.Second).Equal(since)
+}
+
+// eTagMatches checks an If-Match/If-None-Match header value, a list of
+// entity tags or "*", against the ETag of an object using weak comparison
+func eTagMatches(header, eTag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if eTag != "" && strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(eTag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func notModified(w http.ResponseWriter, info storage.ObjectInfo) {
+	if eTag := objectETag(info); eTag != "" {
+		w.Header().Set("ETag", eTag)
+	}
+	w.Header().Set("Last-Modified", httpTime(info.LastModified))
+	w.WriteHeader(http.StatusNotModified)
+}
+
+func preconditionFailed(w http.ResponseWriter) {
+	utils.DisplayErrorWoErr(w, utils.ErrPreconditionFailed, "")
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"triple-s/internal/storage"
+	"triple-s/utils"
+)
+
+type CopyObjectResult struct {
+	XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+	LastModified string
+	ETag         string
+}
+
+// CopyObject handles PUT /{BucketName}/{ObjectKey} with the x-amz-copy-source header
+// by streaming the source object (of the same or another bucket) into the destination
+func CopyObject(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+	objectKey := req.PathValue("ObjectKey")
+
+	sourceBucket, sourceKey, sourceVersion, err := parseCopySource(req.Header.Get("x-amz-copy-source"))
+	if err != nil {
+		utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, err.Error())
+		return
+	}
+
+	directive := req.Header.Get("x-amz-metadata-directive")
+	if directive == "" {
+		directive = "COPY"
+	} else if directive != "COPY" && directive != "REPLACE" {
+		utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, "Unknown metadata directive")
+		return
+	}
+
+	replacedMetadata, err := requestMetadata(req.Header)
+	if err != nil {
+		displayStorageError(w, err, "")
+		return
+	}
+
+	// the copy is encrypted as requested for it, whatever the encryption of the source
+	encryption, customerKey, err := requestEncryption(req.Header)
+	if err == nil {
+		err = checkEncryptionSupport(store, encryption)
+	}
+	if err != nil {
+		displayStorageError(w, err, "")
+		return
+	}
+	sourceCustomerKey, err := requestCustomerKey(req.Header, sseCopySourceCustomerPrefix)
+	if err != nil {
+		displayStorageError(w, err, "")
+		return
+	}
+
+	if err := storage.ValidateObjectKey(objectKey); err != nil {
+		displayStorageError(w, err, "")
+		return
+	}
+	if _, err := store.StatBucket(bucketName); err != nil {
+		displayStorageError(w, err, "Failed to read the bucket: ")
+		return
+	}
+
+	// the source is the current version of the object unless the copy source names a version
+	sourceInfo, sourceFile, err := openObject(store, sourceBucket, sourceKey, sourceVersion, sourceCustomerKey)
+	if err != nil {
+		displayStorageError(w, err, "Failed to open the source object: ")
+		return
+	}
+	defer sourceFile.Close()
+
+	if sourceBucket == bucketName && sourceKey == objectKey && sourceVersion == "" && directive == "COPY" && encryption == "" {
+		utils.DisplayErrorWoErr(w, utils.ErrInvalidRequest, "This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata")
+		return
+	}
+
+	// COPY keeps the metadata of the source while REPLACE takes it from the request
+	opts := storage.PutOptions{ContentType: sourceInfo.ContentType, Metadata: sourceInfo.Metadata, Encryption: encryption, CustomerKey: customerKey}
+	if directive == "REPLACE" {
+		opts.ContentType = requestContentType(req.Header, sourceInfo.ContentType)
+		opts.Metadata = replacedMetadata
+	}
+
+	info, err := store.PutObject(bucketName, objectKey, sourceFile, opts)
+	if err != nil {
+		displayStorageError(w, err, "Failed to copy the object: ")
+		return
+	}
+
+	if sourceInfo.VersionID != "" {
+		w.Header().Set("x-amz-copy-source-version-id", sourceInfo.VersionID)
+	}
+	if info.VersionID != "" {
+		w.Header().Set("x-amz-version-id", info.VersionID)
+	}
+	setEncryptionHeaders(w, info)
+	utils.DisplayXML(w, http.StatusOK, CopyObjectResult{
+		LastModified: s3Time(info.LastModified),
+		ETag:         objectETag(info),
+	})
+}
+
+// parseCopySource splits the x-amz-copy-source header, "[/]bucket/key[?versionId=id]"
+// with the key URL-encoded, into the source bucket, key and version id
+func parseCopySource(copySource string) (string, string, string, error) {
+	copySource, query, _ := strings.Cut(strings.TrimPrefix(copySource, "/"), "?")
+
+	sourceVersion := ""
+	if query != "" {
+		values, err := url.ParseQuery(query)
+		if err != nil || !values.Has("versionId") || values.Get("versionId") == "" {
+			return "", "", "", errors.New("Invalid copy source version id")
+		}
+		sourceVersion = values.Get("versionId")
+	}
+
+	unescaped, err := url.PathUnescape(copySource)
+	if err != nil {
+		return "", "", "", errors.New("Invalid copy source encoding")
+	}
+	sourceBucket, sourceKey, found := strings.Cut(unescaped, "/")
+	if !found || sourceBucket == "" || sourceKey == "" {
+		return "", "", "", errors.New("Copy Source must mention the source bucket and key: sourcebucket/sourcekey")
+	}
+	if err := storage.ValidateObjectKey(sourceKey); err != nil {
+		return "", "", "", err
+	}
+	return sourceBucket, sourceKey, sourceVersion, nil
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+
+	"triple-s/internal/storage"
+	"triple-s/utils"
+)
+
+const maxDeleteObjects = 1000
+
+// maxDeleteRequestSize bounds the body of a DeleteObjects request, the list of
+// maxDeleteObjects keys of the longest length and their version ids fits in it
+const maxDeleteRequestSize = 2 << 20
+
+type Delete struct {
+	XMLName xml.Name           `xml:"Delete"`
+	Quiet   bool               `xml:"Quiet"`
+	Objects []ObjectIdentifier `xml:"Object"`
+}
+
+type ObjectIdentifier struct {
+	Key       string
+	VersionId string
+}
+
+type DeleteResult struct {
+	XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []DeletedObject `xml:"Deleted"`
+	Errors  []DeleteError   `xml:"Error"`
+}
+
+type DeletedObject struct {
+	Key                   string
+	VersionId             string `xml:",omitempty"`
+	DeleteMarker          bool   `xml:",omitempty"`
+	DeleteMarkerVersionId string `xml:",omitempty"`
+}
+
+type DeleteError struct {
+	Key       string
+	VersionId string `xml:",omitempty"`
+	Code      string
+	Message   string
+}
+
+// DeleteMultipleObjects handles POST /{BucketName}?delete: the objects listed in the
+// <Delete> body are deleted at once by the storage, reporting the result of every key
+func DeleteMultipleObjects(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+
+	if _, err := store.StatBucket(bucketName); err != nil {
+		displayStorageError(w, err, "Failed to read the bucket: ")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxDeleteRequestSize))
+	if err != nil {
+		displayStorageError(w, err, "Failed to read the request body: ")
+		return
+	}
+	if contentMD5 := req.Header.Get("Content-MD5"); contentMD5 != "" {
+		md5Sum := md5.Sum(body)
+		if contentMD5 != base64.StdEncoding.EncodeToString(md5Sum[:]) {
+			utils.DisplayErrorWoErr(w, utils.ErrBadDigest, "")
+			return
+		}
+	}
+
+	var deleteRequest Delete
+	err = xml.Unmarshal(body, &deleteRequest)
+	if err != nil || len(deleteRequest.Objects) == 0 || len(deleteRequest.Objects) > maxDeleteObjects {
+		utils.DisplayErrorWoErr(w, utils.ErrMalformedXML, "")
+		return
+	}
+
+	objects := make([]storage.ObjectVersion, len(deleteRequest.Objects))
+	for i, object := range deleteRequest.Objects {
+		objects[i] = storage.ObjectVersion{Key: object.Key, VersionID: object.VersionId}
+	}
+	results, err := store.DeleteObjects(bucketName, objects)
+	if err != nil {
+		displayStorageError(w, err, "Failed to delete the objects: ")
+		return
+	}
+
+	var result DeleteResult
+	for i, object := range deleteRequest.Objects {
+		if err := results[i].Err; err != nil {
+			apiError, _ := storageError(err)
+			message := apiError.Description
+			var keyError *storage.InvalidKeyError
+			if errors.As(err, &keyError) || errors.Is(err, storage.ErrKeyTooLong) {
+				message = err.Error()
+			}
+			result.Errors = append(result.Errors, DeleteError{
+				Key:       object.Key,
+				VersionId: object.VersionId,
+				Code:      apiError.Code,
+				Message:   message,
+			})
+			continue
+		}
+		if deleteRequest.Quiet {
+			continue
+		}
+
+		deleted := DeletedObject{Key: object.Key, VersionId: object.VersionId}
+		if results[i].Deleted.DeleteMarker {
+			deleted.DeleteMarker = true
+			deleted.DeleteMarkerVersionId = object.VersionId
+			if object.VersionId == "" {
+				deleted.DeleteMarkerVersionId = storage.DisplayVersionID(results[i].Deleted.VersionID)
+			}
+		}
+		result.Deleted = append(result.Deleted, deleted)
+	}
+
+	utils.DisplayXML(w, http.StatusOK, result)
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+
+	"triple-s/internal/storage"
+)
+
+// objects are encrypted at rest when uploaded with x-amz-server-side-encryption: AES256
+// (SSE-S3, the storage encrypts with keys of its own) or with the customer key headers
+// below (SSE-C, the client sends a 256-bit key which has to be sent again to read the object).
+// The key of the source of a copy is sent with the x-amz-copy-source-* variants of the headers
+const (
+	sseHeader                   = "x-amz-server-side-encryption"
+	sseCustomerPrefix           = "x-amz-server-side-encryption-customer-"
+	sseCopySourceCustomerPrefix = "x-amz-copy-source-server-side-encryption-customer-"
+	sseAlgorithm                = "AES256"
+)
+
+var (
+	errInvalidEncryptionAlgorithm = errors.New("The encryption request you specified is not valid. The valid value is AES256")
+	errInvalidEncryptionKey       = errors.New("The secret key was invalid for the specified algorithm")
+	errEncryptionKeyMD5Mismatch   = errors.New("The calculated MD5 hash of the key did not match the hash that was provided")
+	errEncryptionConflict         = errors.New("Server Side Encryption with Customer provided key is incompatible with the encryption method specified")
+)
+
+// requestEncryption returns the encryption mode, and for SSE-C the key,
+// of an object uploaded with the given headers
+func requestEncryption(header http.Header) (string, []byte, error) {
+	customerKey, err := requestCustomerKey(header, sseCustomerPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch algorithm := header.Get(sseHeader); {
+	case algorithm != "" && customerKey != nil:
+		return "", nil, errEncryptionConflict
+	case algorithm == sseAlgorithm:
+		return storage.EncryptionS3, nil, nil
+	case algorithm != "":
+		return "", nil, errInvalidEncryptionAlgorithm
+	case customerKey != nil:
+		return storage.EncryptionCustomer, customerKey, nil
+	}
+	return "", nil, nil
+}
+
+// requestCustomerKey returns the SSE-C key sent in the headers starting with prefix,
+// nil if there is none. The key has to come with its algorithm and base64 md5
+func requestCustomerKey(header http.Header, prefix string) ([]byte, error) {
+	algorithm := header.Get(prefix + "algorithm")
+	encodedKey := header.Get(prefix + "key")
+	keyMD5 := header.Get(prefix + "key-MD5")
+	if algorithm == "" && encodedKey == "" && keyMD5 == "" {
+		return nil, nil
+	}
+
+	if algorithm != sseAlgorithm {
+		return nil, errInvalidEncryptionAlgorithm
+	}
+	customerKey, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(customerKey) != 32 {
+		return nil, errInvalidEncryptionKey
+	}
+	if keyMD5 != storage.CustomerKeyMD5(customerKey) {
+		return nil, errEncryptionKeyMD5Mismatch
+	}
+	return customerKey, nil
+}
+
+// checkEncryptionSupport fails encrypted uploads to a storage without server-side encryption,
+// which would otherwise store the content in plaintext
+func checkEncryptionSupport(store storage.Storage, encryption string) error {
+	if _, ok := store.(storage.EncryptionStorage); !ok && encryption != "" {
+		return storage.ErrEncryptionNotConfigured
+	}
+	return nil
+}
+
+// openObject reads an object version with the SSE-C key sent for it, if any
+func openObject(store storage.Storage, bucketName, objectKey, versionID string, customerKey []byte) (storage.ObjectInfo, io.ReadSeekCloser, error) {
+	if encryptionStore, ok := store.(storage.EncryptionStorage); ok {
+		return encryptionStore.GetEncryptedObject(bucketName, objectKey, versionID, customerKey)
+	} else if customerKey != nil {
+		return storage.ObjectInfo{}, nil, storage.ErrEncryptionNotConfigured
+	}
+	return store.GetObject(bucketName, objectKey, versionID)
+}
+
+// checkCustomerKey verifies the SSE-C key sent for an object which is not read, as for HEAD
+func checkCustomerKey(info storage.ObjectInfo, customerKey []byte) error {
+	if info.Encryption != storage.EncryptionCustomer {
+		return nil
+	} else if customerKey == nil {
+		return storage.ErrCustomerKeyRequired
+	} else if storage.CustomerKeyMD5(customerKey) != info.CustomerKeyMD5 {
+		return storage.ErrCustomerKeyMismatch
+	}
+	return nil
+}
+
+// setEncryptionHeaders reports how an object is encrypted at rest
+func setEncryptionHeaders(w http.ResponseWriter, info storage.ObjectInfo) {
+	switch info.Encryption {
+	case storage.EncryptionS3:
+		w.Header().Set(sseHeader, sseAlgorithm)
+	case storage.EncryptionCustomer:
+		w.Header().Set(sseCustomerPrefix+"algorithm", sseAlgorithm)
+		w.Header().Set(sseCustomerPrefix+"key-MD5", info.CustomerKeyMD5)
+	}
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+
+	"triple-s/internal/storage"
+	"triple-s/utils"
+)
+
+// storageErrors maps the errors reported by the storage to the S3 errors sent to clients
+var storageErrors = map[error]utils.APIError{
+	storage.ErrNoSuchBucket:            utils.ErrNoSuchBucket,
+	storage.ErrBucketAlreadyExists:     utils.ErrBucketAlreadyExists,
+	storage.ErrBucketNotEmpty:          utils.ErrBucketNotEmpty,
+	storage.ErrNoSuchKey:               utils.ErrNoSuchKey,
+	storage.ErrNoSuchVersion:           utils.ErrNoSuchVersion,
+	storage.ErrDeleteMarker:            utils.ErrMethodNotAllowed,
+	storage.ErrKeyTooLong:              utils.ErrKeyTooLong,
+	storage.ErrBadDigest:               utils.ErrBadDigest,
+	storage.ErrNoSuchUpload:            utils.ErrNoSuchUpload,
+	storage.ErrInvalidPart:             utils.ErrInvalidPart,
+	storage.ErrInvalidPartOrder:        utils.ErrInvalidPartOrder,
+	storage.ErrEntityTooSmall:          utils.ErrEntityTooSmall,
+	storage.ErrEntityTooLarge:          utils.ErrEntityTooLarge,
+	storage.ErrQuotaExceeded:           utils.ErrQuotaExceeded,
+	storage.ErrCustomerKeyRequired:     utils.ErrCustomerKeyRequired,
+	storage.ErrCustomerKeyMismatch:     utils.ErrCustomerKeyMismatch,
+	storage.ErrEncryptionNotConfigured: utils.ErrNotImplemented,
+	errInvalidEncryptionAlgorithm:      utils.ErrInvalidEncryptionAlgorithm,
+	errInvalidEncryptionKey:            utils.ErrInvalidEncryptionKey,
+	errEncryptionKeyMD5Mismatch:        utils.ErrEncryptionKeyMD5Mismatch,
+	errEncryptionConflict:              utils.ErrEncryptionConflict,
+	errContentSHA256Mismatch:           utils.ErrContentSHA256Mismatch,
+	errChunkSignature:                  utils.ErrSignatureDoesNotMatch,
+	errUnexpectedTrailer:               utils.ErrInvalidRequest,
+	errMetadataTooLarge:                utils.ErrMetadataTooLarge,
+	io.ErrUnexpectedEOF:                utils.ErrIncompleteBody,
+}
+
+// storageError returns the S3 error of a failure reported by the storage or caused by the
+// client while its request body was read, the other failures are internal errors. Only XML
+// documents are read through http.MaxBytesReader, a body over its limit is no valid document
+func storageError(err error) (utils.APIError, bool) {
+	var bucketNameError *storage.InvalidBucketNameError
+	var keyError *storage.InvalidKeyError
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case errors.As(err, &bucketNameError):
+		return utils.ErrInvalidBucketName, true
+	case errors.As(err, &keyError):
+		return utils.ErrInvalidArgument, true
+	case errors.As(err, &maxBytesError):
+		return utils.ErrMalformedXML, true
+	}
+
+	for storageErr, apiError := range storageErrors {
+		if errors.Is(err, storageErr) {
+			return apiError, true
+		}
+	}
+	return utils.ErrInternalError, false
+}
+
+// displayStorageError writes the S3 error response of a failed storage operation,
+// the message is only used to describe internal errors
+func displayStorageError(w http.ResponseWriter, err error, message string) {
+	apiError, ok := storageError(err)
+	if !ok {
+		utils.DisplayError(w, utils.ErrInternalError, message, err)
+		return
+	}
+
+	// invalid names and keys are explained by the reason they were rejected for
+	var bucketNameError *storage.InvalidBucketNameError
+	var keyError *storage.InvalidKeyError
+	if errors.As(err, &bucketNameError) || errors.As(err, &keyError) {
+		utils.DisplayErrorWoErr(w, apiError, err.Error())
+		return
+	}
+	utils.DisplayErrorWoErr(w, apiError, "")
+}
+
+// headError writes the status of a failed HEAD request, which has no body
+func headError(w http.ResponseWriter, err error) {
+	apiError, _ := storageError(err)
+	if errors.Is(err, os.ErrPermission) {
+		apiError = utils.ErrAccessDenied
+	} else if errors.Is(err, os.ErrNotExist) {
+		apiError = utils.ErrNoSuchKey
+	}
+	w.WriteHeader(apiError.StatusCode)
+}
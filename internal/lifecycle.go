@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"triple-s/internal/storage"
+	"triple-s/utils"
+)
+
+// maxLifecycleConfigurationSize bounds the body of a PutBucketLifecycleConfiguration request,
+// 1000 rules with prefixes of the longest key length fit in it
+const maxLifecycleConfigurationSize = 2 << 20
+
+// LifecycleConfiguration holds the lifecycle rules of a bucket. Rules filter the objects
+// by key prefix only, the filters and actions of S3 which depend on object tags, sizes
+// or storage classes are refused rather than applied to more objects than intended
+type LifecycleConfiguration struct {
+	XMLName xml.Name        `xml:"LifecycleConfiguration"`
+	Xmlns   string          `xml:"xmlns,attr,omitempty"`
+	Rules   []LifecycleRule `xml:"Rule"`
+}
+
+// LifecycleRule selects its objects with Filter or, in rules written before Filter was introduced, Prefix
+type LifecycleRule struct {
+	ID                             string           `xml:",omitempty"`
+	Filter                         *LifecycleFilter `xml:",omitempty"`
+	Prefix                         *string          `xml:",omitempty"`
+	Status                         string
+	Expiration                     *LifecycleExpiration            `xml:",omitempty"`
+	NoncurrentVersionExpiration    *NoncurrentVersionExpiration    `xml:",omitempty"`
+	AbortIncompleteMultipartUpload *AbortIncompleteMultipartUpload `xml:",omitempty"`
+	Transitions                    []struct{}                      `xml:"Transition"`
+	NoncurrentVersionTransitions   []struct{}                      `xml:"NoncurrentVersionTransition"`
+}
+
+type LifecycleFilter struct {
+	Prefix                string
+	Tag                   *struct{} `xml:",omitempty"`
+	And                   *struct{} `xml:",omitempty"`
+	ObjectSizeGreaterThan *int64    `xml:",omitempty"`
+	ObjectSizeLessThan    *int64    `xml:",omitempty"`
+}
+
+type LifecycleExpiration struct {
+	Days                      int    `xml:",omitempty"`
+	Date                      string `xml:",omitempty"`
+	ExpiredObjectDeleteMarker bool   `xml:",omitempty"`
+}
+
+type NoncurrentVersionExpiration struct {
+	NoncurrentDays          int
+	NewerNoncurrentVersions *int `xml:",omitempty"`
+}
+
+type AbortIncompleteMultipartUpload struct {
+	DaysAfterInitiation int
+}
+
+func PutBucketLifecycle(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+
+	lifecycleStore, ok := store.(storage.LifecycleStorage)
+	if !ok {
+		utils.DisplayErrorWoErr(w, utils.ErrNotImplemented, "Lifecycle rules are not supported by the storage")
+		return
+	}
+	if _, err := store.StatBucket(bucketName); err != nil {
+		displayStorageError(w, err, "Failed to read the bucket: ")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxLifecycleConfigurationSize))
+	if err != nil {
+		displayStorageError(w, err, "Failed to read the request body: ")
+		return
+	}
+
+	var configuration LifecycleConfiguration
+	err = xml.Unmarshal(body, &configuration)
+	if err != nil || len(configuration.Rules) == 0 || len(configuration.Rules) > 1000 {
+		utils.DisplayErrorWoErr(w, utils.ErrMalformedXML, "")
+		return
+	}
+
+	var rules []storage.LifecycleRule
+	ids := make(map[string]bool)
+	for _, rule := range configuration.Rules {
+		converted, apiError, message := lifecycleRule(rule)
+		if apiError.Code != "" {
+			utils.DisplayErrorWoErr(w, apiError, message)
+			return
+		}
+		if converted.ID != "" && ids[converted.ID] {
+			utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, "Rule ID must be unique. Found same ID for more than one rule")
+			return
+		}
+		ids[converted.ID] = true
+		rules = append(rules, converted)
+	}
+
+	err = lifecycleStore.SetLifecycle(bucketName, rules)
+	if err != nil {
+		displayStorageError(w, err, "Failed to set the lifecycle rules: ")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetBucketLifecycle(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+
+	lifecycleStore, ok := store.(storage.LifecycleStorage)
+	if !ok {
+		utils.DisplayErrorWoErr(w, utils.ErrNotImplemented, "Lifecycle rules are not supported by the storage")
+		return
+	}
+	rules, err := lifecycleStore.Lifecycle(bucketName)
+	if err != nil {
+		displayStorageError(w, err, "Failed to read the lifecycle rules: ")
+		return
+	} else if len(rules) == 0 {
+		utils.DisplayErrorWoErr(w, utils.ErrNoSuchLifecycleConfiguration, "")
+		return
+	}
+
+	configuration := LifecycleConfiguration{Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/"}
+	for _, rule := range rules {
+		listed := LifecycleRule{
+			ID:     rule.ID,
+			Filter: &LifecycleFilter{Prefix: rule.Prefix},
+			Status: "Disabled",
+		}
+		if rule.Enabled {
+			listed.Status = "Enabled"
+		}
+		if rule.ExpirationDays > 0 || !rule.ExpirationDate.IsZero() || rule.ExpiredObjectDeleteMarker {
+			listed.Expiration = &LifecycleExpiration{
+				Days:                      rule.ExpirationDays,
+				ExpiredObjectDeleteMarker: rule.ExpiredObjectDeleteMarker,
+			}
+			if !rule.ExpirationDate.IsZero() {
+				listed.Expiration.Date = rule.ExpirationDate.UTC().Format(time.RFC3339)
+			}
+		}
+		if rule.NoncurrentDays > 0 {
+			listed.NoncurrentVersionExpiration = &NoncurrentVersionExpiration{NoncurrentDays: rule.NoncurrentDays}
+		}
+		if rule.AbortMultipartDays > 0 {
+			listed.AbortIncompleteMultipartUpload = &AbortIncompleteMultipartUpload{DaysAfterInitiation: rule.AbortMultipartDays}
+		}
+		configuration.Rules = append(configuration.Rules, listed)
+	}
+	utils.DisplayXML(w, http.StatusOK, configuration)
+}
+
+func DeleteBucketLifecycle(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+
+	lifecycleStore, ok := store.(storage.LifecycleStorage)
+	if !ok {
+		utils.DisplayErrorWoErr(w, utils.ErrNotImplemented, "Lifecycle rules are not supported by the storage")
+		return
+	}
+	err := lifecycleStore.SetLifecycle(bucketName, nil)
+	if err != nil {
+		displayStorageError(w, err, "Failed to delete the lifecycle rules: ")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ExpireObjects applies the lifecycle rules of the buckets every interval, starting right away,
+// for as long as the server runs. Storages without lifecycle support have nothing to expire
+func ExpireObjects(store storage.Storage, interval time.Duration) {
+	lifecycleStore, ok := store.(storage.LifecycleStorage)
+	if !ok {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		expired, err := lifecycleStore.ApplyLifecycle(time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to apply the lifecycle rules: %v\n", err)
+		}
+		if expired > 0 {
+			fmt.Printf("Lifecycle rules expired %d object versions and uploads\n", expired)
+		}
+		<-ticker.C
+	}
+}
+
+// lifecycleRule validates a rule of a lifecycle configuration and converts it for the storage,
+// an invalid rule is reported with the error and message to send back
+func lifecycleRule(rule LifecycleRule) (storage.LifecycleRule, utils.APIError, string) {
+	converted := storage.LifecycleRule{ID: rule.ID}
+
+	switch rule.Status {
+	case "Enabled":
+		converted.Enabled = true
+	case "Disabled":
+	default:
+		return converted, utils.ErrMalformedXML, ""
+	}
+	if len(rule.ID) > 255 {
+		return converted, utils.ErrInvalidArgument, "ID length should not exceed allowed limit of 255"
+	}
+
+	switch {
+	case rule.Filter != nil && rule.Prefix != nil:
+		return converted, utils.ErrMalformedXML, ""
+	case rule.Filter != nil:
+		filter := rule.Filter
+		if filter.Tag != nil || filter.And != nil || filter.ObjectSizeGreaterThan != nil || filter.ObjectSizeLessThan != nil {
+			return converted, utils.ErrNotImplemented, "Lifecycle rules can only filter objects by prefix"
+		}
+		converted.Prefix = filter.Prefix
+	case rule.Prefix != nil:
+		converted.Prefix = *rule.Prefix
+	}
+
+	if len(rule.Transitions) > 0 || len(rule.NoncurrentVersionTransitions) > 0 {
+		return converted, utils.ErrNotImplemented, "Transitions are not supported, there is a single storage class"
+	}
+	if rule.Expiration == nil && rule.NoncurrentVersionExpiration == nil && rule.AbortIncompleteMultipartUpload == nil {
+		return converted, utils.ErrInvalidArgument, "At least one action needs to be specified in a rule"
+	}
+
+	if expiration := rule.Expiration; expiration != nil {
+		actions := 0
+		if expiration.Days != 0 {
+			actions++
+		}
+		if expiration.Date != "" {
+			actions++
+		}
+		if expiration.ExpiredObjectDeleteMarker {
+			actions++
+		}
+		if actions != 1 {
+			return converted, utils.ErrMalformedXML, "Expiration must specify exactly one of Days, Date or ExpiredObjectDeleteMarker"
+		}
+
+		if expiration.Days < 0 {
+			return converted, utils.ErrInvalidArgument, "'Days' for Expiration action must be a positive integer"
+		}
+		converted.ExpirationDays = expiration.Days
+		converted.ExpiredObjectDeleteMarker = expiration.ExpiredObjectDeleteMarker
+		if expiration.Date != "" {
+			date, err := time.Parse(time.RFC3339, expiration.Date)
+			if err != nil {
+				return converted, utils.ErrInvalidArgument, "'Date' must be in ISO 8601 format"
+			}
+			if date.UTC().Truncate(24*time.Hour) != date.UTC() {
+				return converted, utils.ErrInvalidArgument, "'Date' must be at midnight GMT"
+			}
+			converted.ExpirationDate = date
+		}
+	}
+
+	if expiration := rule.NoncurrentVersionExpiration; expiration != nil {
+		if expiration.NewerNoncurrentVersions != nil {
+			return converted, utils.ErrNotImplemented, "NewerNoncurrentVersions is not supported"
+		}
+		if expiration.NoncurrentDays <= 0 {
+			return converted, utils.ErrInvalidArgument, "'NoncurrentDays' for NoncurrentVersionExpiration action must be a positive integer"
+		}
+		converted.NoncurrentDays = expiration.NoncurrentDays
+	}
+
+	if abort := rule.AbortIncompleteMultipartUpload; abort != nil {
+		if abort.DaysAfterInitiation <= 0 {
+			return converted, utils.ErrInvalidArgument, "'DaysAfterInitiation' for AbortIncompleteMultipartUpload action must be a positive integer"
+		}
+		converted.AbortMultipartDays = abort.DaysAfterInitiation
+	}
+	return converted, utils.APIError{}, ""
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// the metadata sent with an object is returned with it: the standard headers below
+// and the user-defined x-amz-meta-* headers, kept by their lower case names
+const (
+	userMetadataPrefix  = "x-amz-meta-"
+	maxUserMetadataSize = 2 << 10
+)
+
+var storedHeaders = []string{"Cache-Control", "Content-Disposition", "Content-Encoding", "Content-Language", "Expires"}
+
+var errMetadataTooLarge = errors.New("Your metadata headers exceed the maximum allowed metadata size")
+
+// requestMetadata returns the metadata of an object uploaded with the given headers
+func requestMetadata(header http.Header) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, name := range storedHeaders {
+		if value := header.Get(name); value != "" {
+			metadata[strings.ToLower(name)] = value
+		}
+	}
+
+	// S3 limits the user-defined metadata to 2 KB counting the names and values
+	userMetadataSize := 0
+	for name, values := range header {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, userMetadataPrefix) {
+			continue
+		}
+		value := strings.Join(values, ",")
+		userMetadataSize += len(name) - len(userMetadataPrefix) + len(value)
+		metadata[name] = value
+	}
+	if userMetadataSize > maxUserMetadataSize {
+		return nil, errMetadataTooLarge
+	}
+
+	return metadata, nil
+}
+
+// requestContentType returns the Content-Type sent by the client, falling back
+// to the one of the source object when there was none
+func requestContentType(header http.Header, fallback string) string {
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		return contentType
+	}
+	return fallback
+}
+
+// setMetadataHeaders sets the headers of the metadata stored with an object
+func setMetadataHeaders(w http.ResponseWriter, metadata map[string]string) {
+	for name, value := range metadata {
+		// user-defined metadata keeps the lower case name it was stored with
+		if strings.HasPrefix(name, userMetadataPrefix) {
+			w.Header()[name] = []string{value}
+		} else {
+			w.Header().Set(name, value)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package internal
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"triple-s/internal/storage"
+	"triple-s/utils"
+)
+
+// maxCompleteUploadSize bounds the body of a CompleteMultipartUpload request, the list of
+// 10000 parts fits in it
+const maxCompleteUploadSize = 1 << 20
+
+type InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type CompletedMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []CompletedPart `xml:"Part"`
+}
+
+type CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+type ListPartsResult struct {
+	XMLName              xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+	Bucket               string
+	Key                  string
+	UploadId             string
+	PartNumberMarker     int
+	NextPartNumberMarker int
+	MaxParts             int
+	IsTruncated          bool
+	Parts                []ListedPart `xml:"Part"`
+}
+
+type ListedPart struct {
+	PartNumber   int
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+// multipartStorage returns the storage as a MultipartStorage,
+// displaying an error if the storage does not support multipart uploads
+func multipartStorage(w http.ResponseWriter, store storage.Storage) (storage.MultipartStorage, bool) {
+	multipartStore, ok := store.(storage.MultipartStorage)
+	if !ok {
+		utils.DisplayErrorWoErr(w, utils.ErrNotImplemented, "Multipart uploads are not supported by the storage")
+	}
+	return multipartStore, ok
+}
+
+func CreateMultipartUpload(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+	objectKey := req.PathValue("ObjectKey")
+
+	multipartStore, ok := multipartStorage(w, store)
+	if !ok {
+		return
+	}
+
+	metadata, err := requestMetadata(req.Header)
+	if err != nil {
+		displayStorageError(w, err, "")
+		return
+	}
+	// the parts of an SSE-C upload are sent with the key it was created with
+	encryption, customerKey, err := requestEncryption(req.Header)
+	if err == nil {
+		err = checkEncryptionSupport(store, encryption)
+	}
+	if err != nil {
+		displayStorageError(w, err, "")
+		return
+	}
+
+	uploadID, err := multipartStore.CreateMultipartUpload(bucketName, objectKey, storage.PutOptions{
+		ContentType: req.Header.Get("Content-Type"),
+		Metadata:    metadata,
+		Encryption:  encryption,
+		CustomerKey: customerKey,
+	})
+	if err != nil {
+		displayStorageError(w, err, "Failed to create the upload: ")
+		return
+	}
+
+	setEncryptionHeaders(w, storage.ObjectInfo{Encryption: encryption, CustomerKeyMD5: storage.CustomerKeyMD5(customerKey)})
+
+	utils.DisplayXML(w, http.StatusOK, InitiateMultipartUploadResult{
+		Bucket:   bucketName,
+		Key:      objectKey,
+		UploadId: uploadID,
+	})
+}
+
+func UploadPart(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+	objectKey := req.PathValue("ObjectKey")
+	uploadID := req.URL.Query().Get("uploadId")
+
+	partNumber, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > storage.MaxPartNumber {
+		utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, "Part number must be an integer between 1 and 10000")
+		return
+	}
+
+	multipartStore, ok := multipartStorage(w, store)
+	if !ok {
+		return
+	}
+
+	customerKey, err := requestCustomerKey(req.Header, sseCustomerPrefix)
+	if err != nil {
+		displayStorageError(w, err, "")
+		return
+	}
+	part, err := multipartStore.UploadPart(bucketName, objectKey, uploadID, partNumber, req.Body, req.Header.Get("Content-MD5"), customerKey)
+	if err != nil {
+		displayStorageError(w, err, "Failed to store the part: ")
+		return
+	}
+
+	w.Header().Set("ETag", `"`+part.ETag+`"`)
+	if customerKey != nil {
+		setEncryptionHeaders(w, storage.ObjectInfo{Encryption: storage.EncryptionCustomer, CustomerKeyMD5: storage.CustomerKeyMD5(customerKey)})
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func CompleteMultipartUpload(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+	objectKey := req.PathValue("ObjectKey")
+	uploadID := req.URL.Query().Get("uploadId")
+
+	multipartStore, ok := multipartStorage(w, store)
+	if !ok {
+		return
+	}
+	customerKey, err := requestCustomerKey(req.Header, sseCustomerPrefix)
+	if err != nil {
+		displayStorageError(w, err, "")
+		return
+	}
+	// the upload is looked up before the body is read so that unknown uploads fail early
+	if _, err := multipartStore.ListParts(bucketName, objectKey, uploadID); err != nil {
+		displayStorageError(w, err, "Failed to read the upload: ")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxCompleteUploadSize))
+	if err != nil {
+		displayStorageError(w, err, "Failed to read the request body: ")
+		return
+	}
+
+	var completeRequest CompletedMultipartUpload
+	err = xml.Unmarshal(body, &completeRequest)
+	if err != nil || len(completeRequest.Parts) == 0 {
+		utils.DisplayErrorWoErr(w, utils.ErrMalformedXML, "")
+		return
+	}
+
+	parts := make([]storage.PartInfo, len(completeRequest.Parts))
+	for i, completedPart := range completeRequest.Parts {
+		parts[i] = storage.PartInfo{PartNumber: completedPart.PartNumber, ETag: completedPart.ETag}
+	}
+	info, err := multipartStore.CompleteMultipartUpload(bucketName, objectKey, uploadID, parts, customerKey)
+	if err != nil {
+		displayStorageError(w, err, "Failed to assemble the object: ")
+		return
+	}
+
+	if info.VersionID != "" {
+		w.Header().Set("x-amz-version-id", info.VersionID)
+	}
+	setEncryptionHeaders(w, info)
+	utils.DisplayXML(w, http.StatusOK, CompleteMultipartUploadResult{
+		Location: "http://" + req.Host + (&url.URL{Path: "/" + bucketName + "/" + objectKey}).EscapedPath(),
+		Bucket:   bucketName,
+		Key:      objectKey,
+		ETag:     objectETag(info),
+	})
+}
+
+func AbortMultipartUpload(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+	objectKey := req.PathValue("ObjectKey")
+	uploadID := req.URL.Query().Get("uploadId")
+
+	multipartStore, ok := multipartStorage(w, store)
+	if !ok {
+		return
+	}
+
+	err := multipartStore.AbortMultipartUpload(bucketName, objectKey, uploadID)
+	if err != nil {
+		displayStorageError(w, err, "Failed to remove the parts of the upload: ")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ListParts(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+	objectKey := req.PathValue("ObjectKey")
+	query := req.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	maxParts := 1000
+	if query.Has("max-parts") {
+		value, err := strconv.Atoi(query.Get("max-parts"))
+		if err != nil || value < 0 {
+			utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, "max-parts must be a non-negative integer")
+			return
+		}
+		maxParts = min(value, 1000)
+	}
+	partNumberMarker := 0
+	if query.Has("part-number-marker") {
+		value, err := strconv.Atoi(query.Get("part-number-marker"))
+		if err != nil || value < 0 {
+			utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, "part-number-marker must be a non-negative integer")
+			return
+		}
+		partNumberMarker = value
+	}
+
+	multipartStore, ok := multipartStorage(w, store)
+	if !ok {
+		return
+	}
+
+	parts, err := multipartStore.ListParts(bucketName, objectKey, uploadID)
+	if err != nil {
+		displayStorageError(w, err, "Failed to read the parts: ")
+		return
+	}
+
+	result := ListPartsResult{
+		Bucket:           bucketName,
+		Key:              objectKey,
+		UploadId:         uploadID,
+		PartNumberMarker: partNumberMarker,
+		MaxParts:         maxParts,
+	}
+	for _, part := range parts {
+		if part.PartNumber <= partNumberMarker {
+			continue
+		}
+		if len(result.Parts) == maxParts {
+			result.IsTruncated = true
+			break
+		}
+		result.Parts = append(result.Parts, ListedPart{
+			PartNumber:   part.PartNumber,
+			LastModified: s3Time(part.LastModified),
+			ETag:         `"` + part.ETag + `"`,
+			Size:         part.Size,
+		})
+		result.NextPartNumberMarker = part.PartNumber
+	}
+
+	utils.DisplayXML(w, http.StatusOK, result)
+}
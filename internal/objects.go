@@ -1,17 +1,17 @@
 package internal
 
 import (
-	"encoding/csv"
+	"encoding/base64"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"regexp"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"triple-s/internal/storage"
 	"triple-s/utils"
 )
 
@@ -23,276 +23,340 @@ type Object struct {
 	LastModifiedTime string
 }
 
-func CreateObjects(w http.ResponseWriter, req *http.Request, dir string) {
-	path := req.URL.Path[1:]
-	pathSlice := strings.Split(path, "/")
-	fmt.Println(dir)
+func CreateObjects(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+	objectKey := req.PathValue("ObjectKey")
 
-	if len(pathSlice) < 2 {
-		utils.DisplayErrorWoErr(w, http.StatusBadRequest, "Invalid path format")
-		return
-	}
-
-	bucketName := pathSlice[0]
-	objectKey := pathSlice[1]
-
-	fmt.Println("path:", path)
 	fmt.Println("bucket name:", bucketName)
 	fmt.Println("object key:", objectKey)
 
-	pattern := `^[a-z0-9](?:[a-z0-9-]*[a-z0-9])?(?:\.[a-z0-9](?:[a-z0-9-]*[a-z0-9])?)*$`
-	r, err := regexp.Compile(pattern)
+	// the standard and x-amz-meta-* headers are kept with the object
+	metadata, err := requestMetadata(req.Header)
 	if err != nil {
-		utils.DisplayErrorWoErr(w, http.StatusInternalServerError, "Failed to compile regex pattern")
+		displayStorageError(w, err, "")
 		return
 	}
-
-	if !r.MatchString(objectKey) {
-		utils.DisplayErrorWoErr(w, http.StatusBadRequest, "Incorrect object name")
-		return
+	encryption, customerKey, err := requestEncryption(req.Header)
+	if err == nil {
+		err = checkEncryptionSupport(store, encryption)
 	}
-
-	// checking whether a bucket exists or not
-	bucketExistence := utils.CheckBucketExistence(w, bucketName, dir)
-	if !bucketExistence {
+	if err != nil {
+		displayStorageError(w, err, "")
 		return
 	}
 
-	// reading request body
-	objectContent, err := io.ReadAll(req.Body)
+	// the content type sniffed from the data is used when the client sent none
+	info, err := store.PutObject(bucketName, objectKey, req.Body, storage.PutOptions{
+		ContentType: req.Header.Get("Content-Type"),
+		ContentMD5:  req.Header.Get("Content-MD5"),
+		Metadata:    metadata,
+		Encryption:  encryption,
+		CustomerKey: customerKey,
+	})
 	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to read binary content of the request", err)
+		displayStorageError(w, err, "Failed to create the object: ")
 		return
 	}
 
-	// creating an object
-	err = os.WriteFile(dir+"/"+path, objectContent, 0o644)
-	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to create a file", err)
-		return
+	w.Header().Set("ETag", objectETag(info))
+	setEncryptionHeaders(w, info)
+	if info.VersionID != "" {
+		w.Header().Set("x-amz-version-id", info.VersionID)
 	}
+	utils.DisplaySuccess(w, 200, "Object was created and metadata was written")
+}
 
-	// creating objects.csv: it either appends or creates new entries
-	objectsCsv, err := os.OpenFile(dir+"/"+bucketName+"/objects.csv", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+func GetObjects(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+	objectKey := req.PathValue("ObjectKey")
+	fmt.Println("bucket name: " + bucketName)
+	fmt.Println("object key: " + objectKey)
+
+	// reading the object, or the requested version of it, together with its content
+	versionID, err := requestVersionID(req)
 	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Error creating objects.csv", err)
+		displayStorageError(w, err, "")
 		return
 	}
-	defer objectsCsv.Close()
-
-	// preparing object metada
-	lastModifiedTime := time.Now().Format(time.RFC850)
-	contentType := http.DetectContentType(objectContent)
-	fileInfo, err := os.Stat(dir + "/" + path)
+	// objects stored with SSE-C are only read with the key they were encrypted with
+	customerKey, err := requestCustomerKey(req.Header, sseCustomerPrefix)
 	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to open the file: ", err)
+		displayStorageError(w, err, "")
 		return
 	}
-	size := strconv.Itoa(int(fileInfo.Size()))
-	record := []string{pathSlice[1], size, contentType, lastModifiedTime}
-
-	// checking if the same object was already in the .csv storage
-	alreadyPresent := false
-	csvReader := csv.NewReader(objectsCsv)
-	records, err := csvReader.ReadAll()
+	info, file, err := openObject(store, bucketName, objectKey, versionID, customerKey)
 	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to read the metada from objects.csv: ", err)
+		setDeleteMarkerHeaders(w, err, versionID)
+		displayStorageError(w, err, "Failed to open the object: ")
 		return
 	}
+	defer file.Close()
 
-	var newRecords [][]string
-	for _, v := range records {
-		if v[0] == pathSlice[1] {
-			alreadyPresent = true
-			newRecords = append(newRecords, record)
-		} else {
-			newRecords = append(newRecords, v)
-		}
+	// evaluating If-Match, If-None-Match, If-Modified-Since and If-Unmodified-Since
+	if !checkPreconditions(w, req, info) {
+		return
 	}
 
-	// depending on whether the object was already in the bucket:
-	// either adding metadata of a new object
-	// or updating metadata of an existing object
-
-	// writing to objects.csv
-	csv_writer := csv.NewWriter(objectsCsv)
-	defer csv_writer.Flush()
-	if alreadyPresent {
-		utils.UpdateCSV(objectsCsv, w, newRecords, csv_writer)
-	} else {
-		if err := csv_writer.Write(record); err != nil {
-			utils.DisplayError(w, http.StatusInternalServerError, "Failed to write/append to objects.csv: ", err)
+	// serving only the requested ranges when the client asked for a part of the object
+	if rangeHeader := req.Header.Get("Range"); rangeHeader != "" && checkIfRange(req, info) {
+		ranges, err := parseRange(rangeHeader, info.Size)
+		if err == errUnsatisfiableRange {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(info.Size, 10))
+			utils.DisplayErrorWoErr(w, utils.ErrInvalidRange, "")
+			return
+		} else if err == nil {
+			setObjectHeaders(w, info)
+			serveRanges(w, file, info.ContentType, info.Size, ranges)
 			return
 		}
 	}
 
-	// setting the status of a bucket as Active in buckets.csv
-	// and updating its last modified time
-	bucketsCsv, err := os.OpenFile(dir+"/buckets.csv", os.O_RDWR, 0o644)
+	// setting headers and streaming the content to http.ResponseWriter
+	setObjectHeaders(w, info)
+	io.Copy(w, file)
+}
+
+func HeadObject(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+	objectKey := req.PathValue("ObjectKey")
+
+	versionID, err := requestVersionID(req)
 	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to open buckets.csv: ", err)
+		headError(w, err)
 		return
 	}
-	defer bucketsCsv.Close()
-
-	csvReaderBuckets := csv.NewReader(bucketsCsv)
-	bucketRecords, err := csvReaderBuckets.ReadAll()
+	customerKey, err := requestCustomerKey(req.Header, sseCustomerPrefix)
 	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to read the buckets.csv: ", err)
+		headError(w, err)
 		return
 	}
-
-	var newBucketRecords [][]string
-	for _, bucketRecord := range bucketRecords {
-		if bucketRecord[0] == bucketName {
-			newBucketRecord := []string{bucketName, bucketRecord[1], time.Now().Format(time.RFC850), "False"}
-			newBucketRecords = append(newBucketRecords, newBucketRecord)
-		} else {
-			newBucketRecords = append(newBucketRecords, bucketRecord)
-		}
+	info, err := store.StatObject(bucketName, objectKey, versionID)
+	if err != nil {
+		setDeleteMarkerHeaders(w, err, versionID)
+		headError(w, err)
+		return
+	}
+	if err := checkCustomerKey(info, customerKey); err != nil {
+		headError(w, err)
+		return
 	}
 
-	// writing to the buckets.csv the lastModifiedTime and Empty/Not Empty
-	csvWriterBuckets := csv.NewWriter(bucketsCsv)
-	defer csvWriterBuckets.Flush()
-	utils.UpdateCSV(bucketsCsv, w, newBucketRecords, csvWriterBuckets)
+	if !checkPreconditions(w, req, info) {
+		return
+	}
 
-	utils.DisplaySuccess(w, 200, "Object was created and metadata was written")
+	setObjectHeaders(w, info)
+	w.WriteHeader(http.StatusOK)
 }
 
-func GetObjects(w http.ResponseWriter, req *http.Request, dir string) {
-	path := req.URL.Path[1:]
-	pathSlice := strings.Split(path, "/")
-	bucketName := pathSlice[0]
-	fmt.Println("path: " + path)
-	fmt.Println("bucket name: " + bucketName)
-
-	// checking bucket existence
-	bucketExistence := utils.CheckBucketExistence(w, bucketName, dir)
-	if !bucketExistence {
-		return
+// setObjectHeaders sets the headers describing an object
+func setObjectHeaders(w http.ResponseWriter, info storage.ObjectInfo) {
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Last-Modified", httpTime(info.LastModified))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if eTag := objectETag(info); eTag != "" {
+		w.Header().Set("ETag", eTag)
+	}
+	if info.VersionID != "" {
+		w.Header().Set("x-amz-version-id", info.VersionID)
 	}
+	setMetadataHeaders(w, info.Metadata)
+	setEncryptionHeaders(w, info)
+}
 
-	// checking if an object exists in the objects.csv metadata storage
-	objectExistence, objectID, objectsRecords := utils.CheckObjectExistence(w, bucketName, pathSlice[1], dir)
-	if !objectExistence {
-		return
+// objectETag returns the quoted ETag of an object, objects stored before
+// ETags were introduced have none
+func objectETag(info storage.ObjectInfo) string {
+	if info.ETag == "" {
+		return ""
 	}
+	return `"` + info.ETag + `"`
+}
 
-	// opening the file to get its binary data
-	file, err := os.Open(dir + "/" + path)
+func DeleteObjects(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+	objectKey := req.PathValue("ObjectKey")
+	fmt.Println("bucket name: " + bucketName)
+	fmt.Println("object key: " + objectKey)
+
+	// deleting a specific version is permanent, otherwise versioning keeps the object behind a delete marker
+	versionID, err := requestVersionID(req)
 	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to open the file to read its binary data: ", err)
+		displayStorageError(w, err, "")
 		return
 	}
-	defer file.Close()
-
-	binaryFile, err := io.ReadAll(file)
+	deleted, err := store.DeleteObject(bucketName, objectKey, versionID)
 	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to read binary content of the file: ", err)
+		displayStorageError(w, err, "Failed to delete the object: ")
 		return
 	}
 
-	// setting headers and writing to http.ResponseWriter
-	w.Header().Set("Content-Length", objectsRecords[objectID][1])
-	w.Header().Set("Content-Type", objectsRecords[objectID][2])
-	w.Header().Set("Last-Modified", objectsRecords[objectID][3])
-	w.Write(binaryFile)
+	if deleted.DeleteMarker {
+		w.Header().Set("x-amz-delete-marker", "true")
+	}
+	if versionID != "" {
+		w.Header().Set("x-amz-version-id", versionID)
+	} else if deleted.DeleteMarker {
+		w.Header().Set("x-amz-version-id", storage.DisplayVersionID(deleted.VersionID))
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func DeleteObjects(w http.ResponseWriter, req *http.Request, dir string) {
-	path := req.URL.Path[1:]
-	pathSlice := strings.Split(path, "/")
-	bucketName := pathSlice[0]
-	fmt.Println("path: " + path)
-	fmt.Println("bucket name: " + bucketName)
+type ListBucketResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	EncodingType          string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	Contents              []ListedObject
+	CommonPrefixes        []CommonPrefix
+}
 
-	bucketExistence := utils.CheckBucketExistence(w, bucketName, dir)
-	if !bucketExistence {
-		return
-	}
+type ListedObject struct {
+	Key          string
+	LastModified string
+	ETag         string `xml:",omitempty"`
+	Size         int64
+	StorageClass string
+}
 
-	objectExistence, _, objectsRecords := utils.CheckObjectExistence(w, bucketName, pathSlice[1], dir)
-	if !objectExistence {
-		return
-	}
+type CommonPrefix struct {
+	Prefix string
+}
 
-	objectsCsv, err := os.OpenFile(dir+"/"+bucketName+"/objects.csv", os.O_RDWR, 0o644)
-	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to open the objects.csv: ", err)
-		return
-	}
-	defer objectsCsv.Close()
+func ListObjects(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+	query := req.URL.Query()
 
-	// deleting the object
-	err = os.Remove(dir + "/" + bucketName + "/" + pathSlice[1])
-	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to delete the file: ", err)
+	if query.Has("list-type") && query.Get("list-type") != "2" {
+		utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, "Only list-type=2 is supported")
 		return
 	}
 
-	// deleting its metadata
-	var newObjectRecords [][]string
-	for _, objectRecord := range objectsRecords {
-		if objectRecord[0] == pathSlice[1] {
-			continue
-		} else {
-			newObjectRecords = append(newObjectRecords, objectRecord)
+	maxKeys := 1000
+	if query.Has("max-keys") {
+		value, err := strconv.Atoi(query.Get("max-keys"))
+		if err != nil || value < 0 {
+			utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, "max-keys must be a non-negative integer")
+			return
 		}
+		maxKeys = min(value, 1000)
 	}
 
-	csvWriterObjects := csv.NewWriter(objectsCsv)
-	utils.UpdateCSV(objectsCsv, w, newObjectRecords, csvWriterObjects)
-	csvWriterObjects.Flush()
-
-	// checking if objects.csv is empty and updating the bucket's status
-	_, err = objectsCsv.Seek(0, 0)
-	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to reset file pointer: ", err)
+	encodingType := query.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, "Invalid encoding-type: only url is supported")
 		return
 	}
 
-	csvReaderObjects := csv.NewReader(objectsCsv)
-	csvObjectRecords, err := csvReaderObjects.ReadAll()
-	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to read from objects.csv: ", err)
-		return
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	startAfter := query.Get("start-after")
+	continuationToken := query.Get("continuation-token")
+
+	// the continuation token is the last key (or common prefix) of the previous page
+	marker := startAfter
+	if continuationToken != "" {
+		decoded, err := base64.URLEncoding.DecodeString(continuationToken)
+		if err != nil {
+			utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, "The continuation token provided is incorrect")
+			return
+		}
+		marker = string(decoded)
 	}
 
-	bucketIsEmpty := "False"
-	if len(csvObjectRecords) == 0 {
-		bucketIsEmpty = "True"
+	encode := func(value string) string {
+		if encodingType == "url" {
+			return url.QueryEscape(value)
+		}
+		return value
 	}
-	fmt.Println("len of csvObjectRecords: " + strconv.Itoa(len(csvObjectRecords)))
 
-	// updating the last modified time of a bucket in buckets.csv
-	bucketsCsv, err := os.OpenFile(dir+"/buckets.csv", os.O_RDWR, 0o644)
-	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to open buckets.csv: ", err)
-		return
+	result := ListBucketResult{
+		Name:              bucketName,
+		Prefix:            encode(prefix),
+		Delimiter:         encode(delimiter),
+		MaxKeys:           maxKeys,
+		EncodingType:      encodingType,
+		ContinuationToken: continuationToken,
+		StartAfter:        encode(startAfter),
 	}
-	defer bucketsCsv.Close()
 
-	csvReaderBuckets := csv.NewReader(bucketsCsv)
-	bucketRecords, err := csvReaderBuckets.ReadAll()
-	if err != nil {
-		utils.DisplayError(w, http.StatusInternalServerError, "Failed to read the buckets.csv: ", err)
-		return
+	// the objects are read a page at a time from after the marker, once a common prefix is
+	// listed the page is read again from after every key starting with it (the bytes of
+	// UTF-8 keys are never 0xff), so that a page never costs more than the keys it lists
+	var lastEntry string
+	after := marker
+	for done := false; !done; {
+		limit := maxKeys - result.KeyCount + 1
+		objects, err := store.ListObjectsPage(bucketName, prefix, after, limit)
+		if err != nil {
+			displayStorageError(w, err, "Failed to list the objects: ")
+			return
+		}
+		done = len(objects) < limit
+
+		for _, object := range objects {
+			key := object.Key
+			after = key
+
+			// keys containing the delimiter after the prefix are rolled up into a common prefix
+			commonPrefix := ""
+			if delimiter != "" {
+				if idx := strings.Index(key[len(prefix):], delimiter); idx >= 0 {
+					commonPrefix = key[:len(prefix)+idx+len(delimiter)]
+				}
+			}
+			if commonPrefix != "" && strings.HasPrefix(marker, commonPrefix) {
+				after, done = commonPrefix+"\xff", false
+				break
+			}
+
+			if result.KeyCount == maxKeys {
+				result.IsTruncated = maxKeys > 0
+				done = true
+				break
+			}
+
+			result.KeyCount++
+			if commonPrefix != "" {
+				result.CommonPrefixes = append(result.CommonPrefixes, CommonPrefix{Prefix: encode(commonPrefix)})
+				lastEntry = commonPrefix
+				after, done = commonPrefix+"\xff", false
+				break
+			}
+			result.Contents = append(result.Contents, ListedObject{
+				Key:          encode(key),
+				LastModified: s3Time(object.LastModified),
+				ETag:         objectETag(object),
+				Size:         object.Size,
+				StorageClass: "STANDARD",
+			})
+			lastEntry = key
+		}
 	}
 
-	var newBucketRecords [][]string
-	for _, bucketRecord := range bucketRecords {
-		if bucketRecord[0] == bucketName {
-			newBucketRecord := []string{bucketName, bucketRecord[1], time.Now().Format(time.RFC850), bucketIsEmpty}
-			newBucketRecords = append(newBucketRecords, newBucketRecord)
-		} else {
-			newBucketRecords = append(newBucketRecords, bucketRecord)
-		}
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(lastEntry))
 	}
 
-	// writing to the buckets.csv the lastModifiedTime and IsEmpty
-	csvWriterBuckets := csv.NewWriter(bucketsCsv)
-	defer csvWriterBuckets.Flush()
-	utils.UpdateCSV(bucketsCsv, w, newBucketRecords, csvWriterBuckets)
-	w.WriteHeader(http.StatusNoContent)
+	utils.DisplayXML(w, http.StatusOK, result)
+}
+
+// httpTime converts a timestamp of the metadata to the HTTP date format
+func httpTime(t time.Time) string {
+	return t.UTC().Format(http.TimeFormat)
+}
+
+// s3Time converts a timestamp of the metadata to the ISO 8601 form used in S3 listings
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
 }
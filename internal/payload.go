@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+const (
+	// maxChunkLineSize bounds a line of an aws-chunked body, a chunk header or a trailer
+	maxChunkLineSize = 4 << 10
+	// maxTrailers bounds the number of trailers ending an aws-chunked body
+	maxTrailers = 16
+)
+
+// payloadHashReader checks the body against the x-amz-content-sha256 it was signed with,
+// the mismatch is reported instead of io.EOF so that the upload is never committed
+type payloadHashReader struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (r *payloadHashReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.hash.Sum(nil)) != r.expected {
+		return n, errContentSHA256Mismatch
+	}
+	return n, err
+}
+
+func (r *payloadHashReader) Close() error {
+	return r.body.Close()
+}
+
+// chunkedReader decodes an aws-chunked body:
+//
+//	<hex size>[;chunk-signature=<signature>]\r\n<data>\r\n ... 0[;chunk-signature=<signature>]\r\n[<trailers>\r\n]\r\n
+//
+// verifying every chunk signature, each of which signs the previous one, when the payload is signed.
+// Trailers are only accepted when the payload declares them, a signed payload ends them with
+// x-amz-trailer-signature, and a body ending before the final chunk is reported as io.ErrUnexpectedEOF
+type chunkedReader struct {
+	body              io.ReadCloser
+	reader            *bufio.Reader
+	key               []byte
+	sig               signature
+	signed            bool
+	trailer           bool
+	previousSignature string
+	chunkSignature    string
+	chunkHash         hash.Hash
+	remaining         int64
+	inChunk           bool
+	err               error
+}
+
+func newChunkedReader(body io.ReadCloser, key []byte, sig signature, signed, trailer bool) *chunkedReader {
+	return &chunkedReader{
+		body:              body,
+		reader:            bufio.NewReaderSize(body, maxChunkLineSize),
+		key:               key,
+		sig:               sig,
+		signed:            signed,
+		trailer:           trailer,
+		previousSignature: sig.signature,
+		chunkHash:         sha256.New(),
+	}
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for c.err == nil && c.remaining == 0 {
+		if c.inChunk {
+			c.err = c.finishChunk()
+		} else {
+			c.err = c.nextChunk()
+		}
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	n, err := c.reader.Read(p[:min(int64(len(p)), c.remaining)])
+	c.remaining -= int64(n)
+	c.chunkHash.Write(p[:n])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *chunkedReader) Close() error {
+	return c.body.Close()
+}
+
+// nextChunk reads a chunk header, the final zero sized chunk is verified
+// at once and followed by the trailers
+func (c *chunkedReader) nextChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	sizeField, extension, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+	if err != nil || size < 0 {
+		return io.ErrUnexpectedEOF
+	}
+	c.chunkSignature = strings.TrimPrefix(extension, "chunk-signature=")
+	c.chunkHash.Reset()
+	c.remaining = size
+	c.inChunk = true
+
+	if size > 0 {
+		return nil
+	}
+	if err := c.verifyChunk(); err != nil {
+		return err
+	}
+	if err := c.readTrailers(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// readTrailers reads the trailers up to the empty line ending the body, those of a signed
+// payload are followed by their signature, which signs the final chunk
+func (c *chunkedReader) readTrailers() error {
+	var trailers strings.Builder
+	trailerSignature := ""
+	for count := 0; ; count++ {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		} else if line == "" {
+			break
+		} else if !c.trailer || trailerSignature != "" || count == maxTrailers {
+			return errUnexpectedTrailer
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !found || name == "" {
+			return errUnexpectedTrailer
+		}
+		if name == "x-amz-trailer-signature" {
+			trailerSignature = strings.TrimSpace(value)
+			continue
+		}
+		trailers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	if !c.signed || !c.trailer {
+		return nil
+	}
+	trailersHash := sha256.Sum256([]byte(trailers.String()))
+	toSign := "AWS4-HMAC-SHA256-TRAILER\n" + c.sig.amzDate + "\n" + c.sig.scope() + "\n" +
+		c.previousSignature + "\n" + hex.EncodeToString(trailersHash[:])
+	expected := hex.EncodeToString(hmacSHA256(c.key, toSign))
+	if !hmac.Equal([]byte(expected), []byte(trailerSignature)) {
+		return errChunkSignature
+	}
+	return nil
+}
+
+// finishChunk reads the line break after the data of a chunk and verifies its signature
+func (c *chunkedReader) finishChunk() error {
+	line, err := c.readLine()
+	if err != nil || line != "" {
+		return io.ErrUnexpectedEOF
+	}
+	c.inChunk = false
+	return c.verifyChunk()
+}
+
+func (c *chunkedReader) verifyChunk() error {
+	if !c.signed {
+		return nil
+	}
+	toSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + c.sig.amzDate + "\n" + c.sig.scope() + "\n" +
+		c.previousSignature + "\n" + emptySHA256 + "\n" + hex.EncodeToString(c.chunkHash.Sum(nil))
+	expected := hex.EncodeToString(hmacSHA256(c.key, toSign))
+	if !hmac.Equal([]byte(expected), []byte(c.chunkSignature)) {
+		return errChunkSignature
+	}
+	c.previousSignature = c.chunkSignature
+	return nil
+}
+
+// readLine reads a line of the encoding, which never ends the body, a line longer than
+// maxChunkLineSize is malformed
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err == io.EOF || err == bufio.ErrBufferFull {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+
+	"triple-s/internal/storage"
+	"triple-s/utils"
+)
+
+// QuotaConfiguration limits the total size of the object versions of a bucket and their
+// number, a limit which is zero or left out is lifted
+type QuotaConfiguration struct {
+	XMLName    xml.Name `xml:"QuotaConfiguration"`
+	Xmlns      string   `xml:"xmlns,attr,omitempty"`
+	MaxSize    int64    `xml:",omitempty"`
+	MaxObjects int64    `xml:",omitempty"`
+}
+
+func PutBucketQuota(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+
+	quotaStore, ok := store.(storage.QuotaStorage)
+	if !ok {
+		utils.DisplayErrorWoErr(w, utils.ErrNotImplemented, "Quotas are not supported by the storage")
+		return
+	}
+	if _, err := store.StatBucket(bucketName); err != nil {
+		displayStorageError(w, err, "Failed to read the bucket: ")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxConfigurationSize))
+	if err != nil {
+		displayStorageError(w, err, "Failed to read the request body: ")
+		return
+	}
+
+	var configuration QuotaConfiguration
+	err = xml.Unmarshal(body, &configuration)
+	if err != nil {
+		utils.DisplayErrorWoErr(w, utils.ErrMalformedXML, "")
+		return
+	} else if configuration.MaxSize < 0 || configuration.MaxObjects < 0 {
+		utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, "Quota limits must not be negative")
+		return
+	}
+
+	err = quotaStore.SetQuota(bucketName, storage.BucketQuota{
+		MaxSize:    configuration.MaxSize,
+		MaxObjects: configuration.MaxObjects,
+	})
+	if err != nil {
+		displayStorageError(w, err, "Failed to set the quota: ")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetBucketQuota(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+
+	bucket, err := store.StatBucket(bucketName)
+	if err != nil {
+		displayStorageError(w, err, "Failed to read the bucket: ")
+		return
+	}
+
+	utils.DisplayXML(w, http.StatusOK, QuotaConfiguration{
+		Xmlns:      "http://s3.amazonaws.com/doc/2006-03-01/",
+		MaxSize:    bucket.Quota.MaxSize,
+		MaxObjects: bucket.Quota.MaxObjects,
+	})
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"cmp"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidRange       = errors.New("invalid range")
+	errUnsatisfiableRange = errors.New("range not satisfiable")
+)
+
+const (
+	// maxRanges bounds the number of ranges of a request, more are ignored
+	maxRanges = 100
+	// rangeGapSize is the gap under which two ranges are sent as one, about what the
+	// headers of a part of a multipart/byteranges body take
+	rangeGapSize = 80
+)
+
+// byteRange is a single satisfiable range of an object: length bytes starting at start
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return "bytes " + strconv.FormatInt(r.start, 10) + "-" + strconv.FormatInt(r.start+r.length-1, 10) + "/" + strconv.FormatInt(size, 10)
+}
+
+// parseRange parses a Range header (RFC 9110) against an object of the given size.
+// errInvalidRange means the header must be ignored and the whole object served,
+// errUnsatisfiableRange means that none of the requested ranges overlaps the object.
+// As http.ServeContent does, ranges adding up to more than the object are ignored, as
+// are more than maxRanges of them. Several ranges are sorted and those overlapping or
+// close to each other merged, so that serving them reads the content once from the start
+// (backward seeks in compressed objects decompress them over again)
+func parseRange(header string, size int64) ([]byteRange, error) {
+	specs, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return nil, errInvalidRange
+	}
+
+	var ranges []byteRange
+	var specCount int
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		specCount++
+		if specCount > maxRanges {
+			return nil, errInvalidRange
+		}
+		first, last, found := strings.Cut(spec, "-")
+		if !found {
+			return nil, errInvalidRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		// suffix range: the last N bytes of the object
+		if first == "" {
+			suffix, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || suffix < 0 {
+				return nil, errInvalidRange
+			}
+			if suffix == 0 || size == 0 {
+				continue
+			}
+			suffix = min(suffix, size)
+			ranges = append(ranges, byteRange{start: size - suffix, length: suffix})
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, errInvalidRange
+		}
+		end := size - 1
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, errInvalidRange
+			}
+			end = min(end, size-1)
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if specCount == 0 {
+		return nil, errInvalidRange
+	} else if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+
+	total := int64(0)
+	for _, r := range ranges {
+		total += r.length
+	}
+	if total > size {
+		return nil, errInvalidRange
+	}
+	return mergeRanges(ranges), nil
+}
+
+// mergeRanges sorts ranges by their start and merges those which overlap or are less than rangeGapSize apart
+func mergeRanges(ranges []byteRange) []byteRange {
+	slices.SortFunc(ranges, func(a, b byteRange) int {
+		return cmp.Compare(a.start, b.start)
+	})
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.start <= last.start+last.length+rangeGapSize {
+			last.length = max(last.length, r.start+r.length-last.start)
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	return merged
+}
+
+// serveRanges writes the requested ranges of content as a 206 Partial Content response,
+// a single range is sent as is and several ranges as a multipart/byteranges body
+func serveRanges(w http.ResponseWriter, content io.ReadSeeker, contentType string, size int64, ranges []byteRange) error {
+	if len(ranges) == 1 {
+		w.Header().Set("Content-Range", ranges[0].contentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		_, err := content.Seek(ranges[0].start, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(w, content, ranges[0].length)
+		return err
+	}
+
+	multipartWriter := multipart.NewWriter(w)
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+multipartWriter.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
+	for _, r := range ranges {
+		part, err := multipartWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {contentType},
+			"Content-Range": {r.contentRange(size)},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = content.Seek(r.start, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(part, content, r.length)
+		if err != nil {
+			return err
+		}
+	}
+	return multipartWriter.Close()
+}
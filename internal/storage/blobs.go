@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// with deduplication enabled the file of a new object version is stored once per content in
+// the blob store, <dir>/.blobs/<first two digits>/<sha256 of the file>, instead of at the path
+// of the version, and the blob column of its record holds the hash. The metadata keeps the
+// number of records referring to every blob under "r\x00<hash>", updated in the same batch
+// as the records, and a blob is removed together with its last reference. Blobs are hashed
+// as stored, so objects only share one when they are also compressed alike, and encrypted
+// objects never do. Records keep their blob when deduplication is disabled again
+const blobsDir = ".blobs"
+
+// EnableDeduplication stores the files of the object versions written from now on in the
+// blob store. Whether enabled or not, the blob store is read and garbage collected
+func (s *FileStorage) EnableDeduplication() {
+	s.dedup = true
+}
+
+// CollectBlobs is the garbage collection pass of the blob store: the references to the blobs
+// are recounted from the records, wrong counts are corrected and blobs which are no longer
+// referenced removed. It returns the number of blobs removed and the bytes they took
+func (s *FileStorage) CollectBlobs() (int, int64, error) {
+	removed, freed := 0, int64(0)
+	err := s.checkBlobs(func(hash string, size int64, format string, args ...any) bool {
+		if size >= 0 {
+			removed++
+			freed += size
+		}
+		return true
+	})
+	return removed, freed, err
+}
+
+func blobIndexKey(hash string) string {
+	return "r\x00" + hash
+}
+
+func blobPath(dir, hash string) string {
+	return dir + "/" + blobsDir + "/" + hash[:2] + "/" + hash
+}
+
+// recordBlob returns the hash of the blob holding the data of a version, empty if it has its own file
+func recordBlob(record []string) string {
+	if len(record) <= blobColumn {
+		return ""
+	}
+	return record[blobColumn]
+}
+
+// placeObjectFile moves a staged file to where the record of its version will refer to:
+// filePath, or the blob store when deduplicating. The returned blob is pinned so that it
+// is not removed before the record is written, until releaseBlob is called
+func (s *FileStorage) placeObjectFile(staged stagedFile, filePath string) (string, error) {
+	if !s.dedup {
+		return "", commitObjectFile(staged.path, filePath)
+	}
+
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	path := blobPath(s.dir, staged.sha256)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			return "", err
+		}
+		err = os.Rename(staged.path, path)
+		if err != nil {
+			return "", err
+		}
+		err = syncDir(filepath.Dir(path))
+		if err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	if s.blobPins == nil {
+		s.blobPins = make(map[string]int)
+	}
+	s.blobPins[staged.sha256]++
+	return staged.sha256, nil
+}
+
+// releaseBlob unpins a blob placed by placeObjectFile, removing it if no record refers to it
+func (s *FileStorage) releaseBlob(hash string) {
+	if hash == "" {
+		return
+	}
+
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	s.blobPins[hash]--
+	if s.blobPins[hash] > 0 {
+		return
+	}
+	delete(s.blobPins, hash)
+	if s.blobRefs(hash) == 0 {
+		os.Remove(blobPath(s.dir, hash))
+	}
+}
+
+// blobRefs returns the stored reference count of a blob, the caller holds blobMu
+func (s *FileStorage) blobRefs(hash string) int {
+	record, found := s.meta.get(blobIndexKey(hash))
+	if !found || len(record) == 0 {
+		return 0
+	}
+	refs, _ := strconv.Atoi(record[0])
+	return refs
+}
+
+// blobDeltas returns by how much a batch of record updates changes the references to blobs,
+// comparing every record to the one it replaces. The caller holds the bucket lock
+func (s *FileStorage) blobDeltas(ops []metaOp) map[string]int {
+	var deltas map[string]int
+	s.eachReplaced(ops, func(old, new []string) {
+		oldBlob, newBlob := recordBlob(old), recordBlob(new)
+		if oldBlob == newBlob {
+			return
+		}
+		if deltas == nil {
+			deltas = make(map[string]int)
+		}
+		if oldBlob != "" {
+			deltas[oldBlob]--
+		}
+		if newBlob != "" {
+			deltas[newBlob]++
+		}
+	})
+	return deltas
+}
+
+// applyWithBlobs applies a batch of record updates together with the updates of the reference
+// counts of the blobs it changes, removing the blobs left without references once it is written
+func (s *FileStorage) applyWithBlobs(ops []metaOp) error {
+	deltas := s.blobDeltas(ops)
+	if len(deltas) == 0 {
+		return s.meta.apply(ops)
+	}
+
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	var unreferenced []string
+	for hash, delta := range deltas {
+		if delta == 0 {
+			continue
+		}
+		refs := s.blobRefs(hash) + delta
+		if refs > 0 {
+			ops = append(ops, metaOp{blobIndexKey(hash), []string{strconv.Itoa(refs)}})
+		} else {
+			ops = append(ops, metaOp{key: blobIndexKey(hash)})
+			unreferenced = append(unreferenced, hash)
+		}
+	}
+	err := s.meta.apply(ops)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range unreferenced {
+		if s.blobPins[hash] == 0 {
+			os.Remove(blobPath(s.dir, hash))
+		}
+	}
+	return nil
+}
+
+// checkBlobs recounts the references of the records to the blobs and compares them to the
+// stored counts and to the blob files, calling report for every difference with the size of
+// an unreferenced blob file or -1 for a wrong count. What report returns true for is fixed
+func (s *FileStorage) checkBlobs(report func(hash string, size int64, format string, args ...any) bool) error {
+	// the counts only change while blobMu is held, so they hold still for the recount
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	counted := make(map[string]int)
+	for _, prefix := range []string{"o\x00", "v\x00"} {
+		s.meta.ascend(prefix, func(_ string, record []string) bool {
+			if hash := recordBlob(record); hash != "" {
+				counted[hash]++
+			}
+			return true
+		})
+	}
+	stored := make(map[string]int)
+	s.meta.ascend(blobIndexKey(""), func(key string, record []string) bool {
+		refs := 0
+		if len(record) > 0 {
+			refs, _ = strconv.Atoi(record[0])
+		}
+		stored[strings.TrimPrefix(key, blobIndexKey(""))] = refs
+		return true
+	})
+
+	var ops []metaOp
+	for hash, refs := range stored {
+		if counted[hash] == 0 && report(hash, -1, "blob %s has %d references but no record refers to it", hash, refs) {
+			ops = append(ops, metaOp{key: blobIndexKey(hash)})
+		}
+	}
+	for hash, refs := range counted {
+		if stored[hash] != refs && report(hash, -1, "blob %s has %d references but %d records refer to it", hash, stored[hash], refs) {
+			ops = append(ops, metaOp{blobIndexKey(hash), []string{strconv.Itoa(refs)}})
+		}
+	}
+	if len(ops) > 0 {
+		if err := s.meta.apply(ops); err != nil {
+			return err
+		}
+	}
+
+	// blob files which no record refers to, which a crash between writing a blob and its record leaves behind
+	return filepath.WalkDir(s.dir+"/"+blobsDir, func(path string, entry os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil || entry.IsDir() {
+			return err
+		}
+		hash := entry.Name()
+		if counted[hash] > 0 || s.blobPins[hash] > 0 {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if report(hash, info.Size(), "blob %s is not referenced", hash) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove blob %s: %w", hash, err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// the objects written to a bucket with compression enabled are compressed with the
+// algorithm set in the bucket record at that time, which is kept in the compression column
+// of their records next to the size of their file, so that changing the setting leaves
+// the stored objects readable. Compression comes before encryption, and as neither gzip
+// nor flate streams can be entered in the middle a range of a compressed object is read
+// by decompressing it from the start
+const bucketCompressionColumn = 5
+
+var errUnknownCompression = errors.New("unknown compression algorithm")
+
+func (s *FileStorage) SetCompression(bucketName, algorithm string) error {
+	if algorithm != "" && algorithm != CompressionGzip && algorithm != CompressionFlate {
+		return fmt.Errorf("%w %q", errUnknownCompression, algorithm)
+	}
+
+	lock := s.bucketLock(bucketName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := s.findBucket(bucketName); err != nil {
+		return err
+	}
+
+	return s.updateBucket(bucketName, func(record []string) []string {
+		for len(record) <= bucketCompressionColumn {
+			record = append(record, "")
+		}
+		record[bucketCompressionColumn] = algorithm
+		return record
+	})
+}
+
+func (s *FileStorage) BucketUsage(bucketName string) (BucketUsage, error) {
+	lock := s.bucketLock(bucketName)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if _, err := s.findBucket(bucketName); err != nil {
+		return BucketUsage{}, err
+	}
+
+	return s.bucketUsage(bucketName), nil
+}
+
+func bucketCompression(record []string) string {
+	if len(record) <= bucketCompressionColumn {
+		return ""
+	}
+	return record[bucketCompressionColumn]
+}
+
+// recordCompression returns the algorithm the file of a version is compressed with
+func recordCompression(record []string) string {
+	if len(record) <= compressionColumn {
+		return ""
+	}
+	return record[compressionColumn]
+}
+
+// recordStoredSize returns the size of the file of a version, which records written before
+// the stored size was kept do not hold but can only differ from the content size by encryption
+func recordStoredSize(record []string) int64 {
+	if len(record) > storedSizeColumn {
+		if size, err := strconv.ParseInt(record[storedSizeColumn], 10, 64); err == nil {
+			return size
+		}
+	}
+	size, _ := strconv.ParseInt(record[1], 10, 64)
+	if recordEncryption(record) != "" {
+		return encryptedSize(size)
+	}
+	return size
+}
+
+func newCompressor(w io.Writer, algorithm string) (io.WriteCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionFlate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownCompression, algorithm)
+}
+
+func newDecompressor(r io.Reader, algorithm string) (io.ReadCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionFlate:
+		return flate.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownCompression, algorithm)
+}
+
+// decompressReader decompresses the stored content of an object holding size bytes,
+// a seek backwards starts decompressing over from the beginning of the content
+type decompressReader struct {
+	stored    io.ReadSeekCloser
+	algorithm string
+	size      int64
+	offset    int64
+	// reader has decompressed the content up to position
+	reader   io.ReadCloser
+	position int64
+}
+
+func newDecompressReader(stored io.ReadSeekCloser, algorithm string, size int64) *decompressReader {
+	return &decompressReader{stored: stored, algorithm: algorithm, size: size}
+}
+
+func (d *decompressReader) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+
+	if d.reader == nil || d.position > d.offset {
+		if d.reader != nil {
+			d.reader.Close()
+			d.reader = nil
+		}
+		if _, err := d.stored.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		reader, err := newDecompressor(d.stored, d.algorithm)
+		if err != nil {
+			return 0, err
+		}
+		d.reader, d.position = reader, 0
+	}
+	if d.position < d.offset {
+		skipped, err := io.CopyN(io.Discard, d.reader, d.offset-d.position)
+		d.position += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := d.reader.Read(p[:min(int64(len(p)), d.size-d.offset)])
+	d.position += int64(n)
+	d.offset += int64(n)
+	if err == io.EOF && d.offset < d.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (d *decompressReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *decompressReader) Close() error {
+	if d.reader != nil {
+		d.reader.Close()
+	}
+	return d.stored.Close()
+}
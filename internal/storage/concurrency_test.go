@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testStorages returns an empty storage of every backend by name, the filesystem ones
+// kept in temporary directories which are checked with Fsck once the test ends
+func testStorages(t *testing.T) map[string]Storage {
+	t.Helper()
+	deduplicating := testFileStorage(t)
+	deduplicating.EnableDeduplication()
+	return map[string]Storage{
+		"fs":       testFileStorage(t),
+		"fs-dedup": deduplicating,
+		"memory":   NewMemoryStorage(),
+	}
+}
+
+func testFileStorage(t *testing.T) *FileStorage {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := store.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+			return
+		}
+		issues, err := Fsck(dir, false)
+		if err != nil {
+			t.Errorf("Fsck: %v", err)
+		}
+		for _, issue := range issues {
+			t.Errorf("Fsck: %s", issue)
+		}
+	})
+	return store
+}
+
+// expectErr fails the test unless err is nil or one of the allowed errors
+func expectErr(t *testing.T, operation string, err error, allowed ...error) {
+	t.Helper()
+	if err == nil {
+		return
+	}
+	for _, target := range allowed {
+		if errors.Is(err, target) {
+			return
+		}
+	}
+	t.Errorf("%s: unexpected error %v", operation, err)
+}
+
+func readObject(store Storage, bucketName, objectKey string) (string, error) {
+	_, content, err := store.GetObject(bucketName, objectKey, "")
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	return string(data), err
+}
+
+func TestConcurrentObjects(t *testing.T) {
+	const workers, rounds = 8, 25
+
+	for name, store := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.CreateBucket("objects"); err != nil {
+				t.Fatalf("CreateBucket: %v", err)
+			}
+
+			// every worker writes its own keys and all of them fight over the shared ones
+			var wg sync.WaitGroup
+			for worker := 0; worker < workers; worker++ {
+				wg.Add(1)
+				go func(worker int) {
+					defer wg.Done()
+					for round := 0; round < rounds; round++ {
+						own := fmt.Sprintf("worker-%d/key-%d", worker, round)
+						shared := fmt.Sprintf("shared/key-%d", round%3)
+						body := fmt.Sprintf("%d-%d", worker, round)
+
+						_, err := store.PutObject("objects", own, strings.NewReader(body), PutOptions{})
+						expectErr(t, "PutObject", err)
+						_, err = store.PutObject("objects", shared, strings.NewReader(body), PutOptions{})
+						expectErr(t, "PutObject", err)
+
+						data, err := readObject(store, "objects", own)
+						expectErr(t, "GetObject", err)
+						if err == nil && data != body {
+							t.Errorf("GetObject %s: got %q, want %q", own, data, body)
+						}
+						_, err = readObject(store, "objects", shared)
+						expectErr(t, "GetObject", err, ErrNoSuchKey)
+
+						if round%2 == 0 {
+							_, err = store.DeleteObject("objects", own, "")
+							expectErr(t, "DeleteObject", err)
+						}
+						_, err = store.DeleteObject("objects", shared, "")
+						expectErr(t, "DeleteObject", err, ErrNoSuchKey)
+						_, err = store.ListObjects("objects")
+						expectErr(t, "ListObjects", err)
+					}
+				}(worker)
+			}
+			wg.Wait()
+
+			objects, err := store.ListObjects("objects")
+			if err != nil {
+				t.Fatalf("ListObjects: %v", err)
+			}
+			own := 0
+			for _, object := range objects {
+				if strings.HasPrefix(object.Key, "worker-") {
+					own++
+				}
+			}
+			if want := workers * (rounds / 2); own != want {
+				t.Errorf("ListObjects: %d objects of the workers, want %d", own, want)
+			}
+
+			for _, object := range objects {
+				_, err = store.DeleteObject("objects", object.Key, "")
+				expectErr(t, "DeleteObject", err)
+			}
+			bucket, err := store.StatBucket("objects")
+			if err != nil {
+				t.Fatalf("StatBucket: %v", err)
+			} else if !bucket.IsEmpty {
+				t.Errorf("StatBucket: bucket is not empty once all objects were deleted")
+			}
+			if err = store.DeleteBucket("objects"); err != nil {
+				t.Errorf("DeleteBucket: %v", err)
+			}
+		})
+	}
+}
+
+func TestConcurrentBuckets(t *testing.T) {
+	const workers, rounds = 8, 25
+	bucketNames := []string{"bucket-a", "bucket-b", "bucket-c"}
+
+	for name, store := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			// buckets are created, filled, emptied and deleted by every worker at once,
+			// so any step may find the bucket gone, already there or not empty
+			var wg sync.WaitGroup
+			for worker := 0; worker < workers; worker++ {
+				wg.Add(1)
+				go func(worker int) {
+					defer wg.Done()
+					for round := 0; round < rounds; round++ {
+						bucketName := bucketNames[(worker+round)%len(bucketNames)]
+						objectKey := fmt.Sprintf("key-%d", worker)
+
+						err := store.CreateBucket(bucketName)
+						expectErr(t, "CreateBucket", err, ErrBucketAlreadyExists)
+						_, err = store.PutObject(bucketName, objectKey, strings.NewReader("data"), PutOptions{})
+						expectErr(t, "PutObject", err, ErrNoSuchBucket)
+						_, err = store.ListBuckets()
+						expectErr(t, "ListBuckets", err)
+						_, err = store.DeleteObject(bucketName, objectKey, "")
+						expectErr(t, "DeleteObject", err, ErrNoSuchBucket, ErrNoSuchKey)
+						err = store.DeleteBucket(bucketName)
+						expectErr(t, "DeleteBucket", err, ErrNoSuchBucket, ErrBucketNotEmpty)
+					}
+				}(worker)
+			}
+			wg.Wait()
+
+			// whatever survived must still be consistent: its objects listed and readable
+			buckets, err := store.ListBuckets()
+			if err != nil {
+				t.Fatalf("ListBuckets: %v", err)
+			}
+			for _, bucket := range buckets {
+				objects, err := store.ListObjects(bucket.Name)
+				if err != nil {
+					t.Fatalf("ListObjects %s: %v", bucket.Name, err)
+				}
+				if bucket.IsEmpty != (len(objects) == 0) {
+					t.Errorf("bucket %s: IsEmpty is %v with %d objects", bucket.Name, bucket.IsEmpty, len(objects))
+				}
+				for _, object := range objects {
+					if data, err := readObject(store, bucket.Name, object.Key); err != nil || data != "data" {
+						t.Errorf("GetObject %s/%s: got %q, %v", bucket.Name, object.Key, data, err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+)
+
+// readCSV returns all rows of the csv file at path, a missing file has no rows
+func readCSV(path string) ([][]string, error) {
+	csvFile, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer csvFile.Close()
+
+	csvReader := csv.NewReader(csvFile)
+	csvReader.FieldsPerRecord = -1
+	return csvReader.ReadAll()
+}
+
+// writeCSV atomically replaces the contents of the csv file at path with records:
+// they are written to a temporary file next to it, which is synced and renamed over
+// path, so a crash leaves either the old or the new contents but never a partial file
+func writeCSV(path string, records [][]string) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	csvWriter := csv.NewWriter(tmpFile)
+	err = csvWriter.WriteAll(records)
+	if err != nil {
+		return err
+	}
+	err = tmpFile.Chmod(0o644)
+	if err != nil {
+		return err
+	}
+	err = tmpFile.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpFile.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// appendCSV adds a single record to the end of the csv file at path, creating it if needed.
+// A crash may tear the row being appended: readAppendedCSV leaves out a last row without its
+// line break and the next append cuts it off the file before writing its record
+func appendCSV(path string, record []string) error {
+	var row bytes.Buffer
+	csvWriter := csv.NewWriter(&row)
+	csvWriter.Write(record)
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	csvFile, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer csvFile.Close()
+	info, err := csvFile.Stat()
+	if err != nil {
+		return err
+	}
+	if err = cutTornRow(csvFile, info.Size()); err != nil {
+		return err
+	}
+
+	_, err = csvFile.Write(row.Bytes())
+	if err != nil {
+		return err
+	}
+	err = csvFile.Sync()
+	if err != nil {
+		return err
+	}
+	err = csvFile.Close()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// cutTornRow truncates the csv file of the given size after its last line break
+func cutTornRow(csvFile *os.File, size int64) error {
+	last := make([]byte, 1)
+	if size == 0 {
+		return nil
+	} else if _, err := csvFile.ReadAt(last, size-1); err != nil || last[0] == '\n' {
+		return err
+	}
+
+	contents := make([]byte, size)
+	if _, err := csvFile.ReadAt(contents, 0); err != nil {
+		return err
+	}
+	return csvFile.Truncate(int64(bytes.LastIndexByte(contents, '\n') + 1))
+}
+
+// readAppendedCSV returns the rows of a csv file written by appendCSV, without the last
+// one when a crash left it torn
+func readAppendedCSV(path string) ([][]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	csvReader := csv.NewReader(bytes.NewReader(data[:bytes.LastIndexByte(data, '\n')+1]))
+	csvReader.FieldsPerRecord = -1
+	return csvReader.ReadAll()
+}
+
+// syncDir flushes the entries of a directory, making the renames and new files in it durable
+func syncDir(dir string) error {
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
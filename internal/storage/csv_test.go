@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAppendCSVAfterTornRow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "parts.csv")
+	if err := appendCSV(path, []string{"1", "first"}); err != nil {
+		t.Fatalf("appendCSV: %v", err)
+	}
+
+	// a crash while the second row was appended left it without its line break
+	csvFile, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvFile.WriteString("2,sec")
+	csvFile.Close()
+
+	records, err := readAppendedCSV(path)
+	if err != nil {
+		t.Fatalf("readAppendedCSV: %v", err)
+	} else if want := [][]string{{"1", "first"}}; !reflect.DeepEqual(records, want) {
+		t.Errorf("readAppendedCSV with a torn row: got %q, want %q", records, want)
+	}
+
+	if err = appendCSV(path, []string{"2", "second"}); err != nil {
+		t.Fatalf("appendCSV: %v", err)
+	}
+	records, err = readAppendedCSV(path)
+	if err != nil {
+		t.Fatalf("readAppendedCSV: %v", err)
+	} else if want := [][]string{{"1", "first"}, {"2", "second"}}; !reflect.DeepEqual(records, want) {
+		t.Errorf("readAppendedCSV after appending: got %q, want %q", records, want)
+	}
+}
@@ -0,0 +1,403 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// an encrypted object file is its content split into chunks of encryptionChunkSize bytes,
+// each sealed with AES-256-GCM under a data key generated for the file, so that a range of
+// the content is read by decrypting only the chunks it spans. The nonce of a chunk is its
+// index followed by a flag marking the last chunk, which makes a truncated file fail to
+// decrypt, and an empty content is stored as a single empty chunk. The data key itself is
+// kept in the record of the object (or the parts.csv row of a part) wrapped with AES-GCM
+// by the master key for SSE-S3 or by the key the client sent for SSE-C, in the encryption
+// column as URL query encoded mode ("sse"), wrapped key ("key") and, for SSE-C, the base64
+// md5 of the customer key ("key-md5") reported back to clients
+const (
+	encryptionChunkSize = 64 << 10
+	encryptionTagSize   = 16
+)
+
+// fileKey is the data key a file is encrypted with together with how it is wrapped
+type fileKey struct {
+	mode           string
+	dataKey        []byte
+	wrapped        string
+	customerKeyMD5 string
+}
+
+// LoadMasterKey reads the hex encoded 256-bit master key SSE-S3 wraps the data keys with,
+// generating it if the file does not exist as long as nothing is encrypted with SSE-S3 yet:
+// a new key would not open the data of the lost one. Without it only SSE-C objects can be
+// stored. The key is better kept outside the storage directory, so that a copy of the
+// directory does not hold the key to its own data
+func (s *FileStorage) LoadMasterKey(path string) error {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if s.hasS3Encrypted() {
+			return fmt.Errorf("%s is missing but objects are encrypted with SSE-S3: %w", path, err)
+		}
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(path), 0o700)
+		if err != nil {
+			return err
+		}
+		keyFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return err
+		}
+		_, err = keyFile.WriteString(hex.EncodeToString(key) + "\n")
+		if err == nil {
+			err = keyFile.Sync()
+		}
+		if closeErr := keyFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+			return err
+		}
+		fmt.Println("Generated a new master key: " + path)
+		s.masterKey = key
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("%s must hold a 256-bit key in hex", path)
+	}
+	s.masterKey = key
+	return nil
+}
+
+// hasS3Encrypted reports whether an object version, multipart upload or part is encrypted
+// with SSE-S3
+func (s *FileStorage) hasS3Encrypted() bool {
+	found := false
+	buckets, _ := s.ListBuckets()
+	for _, bucket := range buckets {
+		for _, prefix := range []string{objectIndexPrefix(bucket.Name), versionIndexPrefix(bucket.Name)} {
+			s.meta.ascend(prefix, func(_ string, record []string) bool {
+				mode, _ := encryptionMode(recordEncryption(record))
+				found = found || mode == EncryptionS3
+				return !found
+			})
+		}
+
+		entries, _ := os.ReadDir(s.dir + "/" + bucket.Name + "/" + multipartDir)
+		for _, entry := range entries {
+			if !entry.IsDir() || !uploadIDPattern.MatchString(entry.Name()) {
+				continue
+			}
+			uploadPath := s.uploadDir(bucket.Name, entry.Name())
+			records, _ := readCSV(uploadPath + "/upload.csv")
+			if len(records) > 0 && len(records[0]) > 4 && records[0][4] == EncryptionS3 {
+				found = true
+			}
+			parts, _ := readParts(uploadPath)
+			for _, part := range parts {
+				mode, _ := encryptionMode(part.encryption)
+				found = found || mode == EncryptionS3
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// newFileKey generates the data key of a file encrypted in the given mode,
+// nil when the file is stored unencrypted
+func (s *FileStorage) newFileKey(mode string, customerKey []byte) (*fileKey, error) {
+	if mode == "" {
+		return nil, nil
+	}
+	kek, err := s.keyEncryptionKey(mode, customerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &fileKey{mode: mode, dataKey: make([]byte, 32)}
+	if _, err := rand.Read(key.dataKey); err != nil {
+		return nil, err
+	}
+	key.wrapped, err = wrapKey(kek, key.dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if mode == EncryptionCustomer {
+		key.customerKeyMD5 = CustomerKeyMD5(customerKey)
+	}
+	return key, nil
+}
+
+// recordKey returns the data key of an encrypted object version (or part) from its
+// encryption column, nil if it is not encrypted. SSE-C data needs the customer key
+func (s *FileStorage) recordKey(encryption string, customerKey []byte) (*fileKey, error) {
+	values, err := url.ParseQuery(encryption)
+	if err != nil || values.Get("sse") == "" {
+		return nil, err
+	}
+
+	key := &fileKey{mode: values.Get("sse"), wrapped: values.Get("key"), customerKeyMD5: values.Get("key-md5")}
+	if key.mode == EncryptionCustomer {
+		if customerKey == nil {
+			return nil, ErrCustomerKeyRequired
+		} else if CustomerKeyMD5(customerKey) != key.customerKeyMD5 {
+			return nil, ErrCustomerKeyMismatch
+		}
+	}
+	kek, err := s.keyEncryptionKey(key.mode, customerKey)
+	if err != nil {
+		return nil, err
+	}
+	// an SSE-C key matching the md5 but not the data key was given wrong, the master key
+	// failing to unwrap an SSE-S3 data key is an internal error
+	key.dataKey, err = unwrapKey(kek, key.wrapped)
+	if err != nil && key.mode == EncryptionCustomer {
+		return nil, ErrCustomerKeyMismatch
+	} else if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// keyEncryptionKey returns the key the data keys of the given mode are wrapped with
+func (s *FileStorage) keyEncryptionKey(mode string, customerKey []byte) ([]byte, error) {
+	switch mode {
+	case EncryptionS3:
+		if s.masterKey == nil {
+			return nil, ErrEncryptionNotConfigured
+		}
+		return s.masterKey, nil
+	case EncryptionCustomer:
+		if len(customerKey) != 32 {
+			return nil, ErrCustomerKeyRequired
+		}
+		return customerKey, nil
+	}
+	return nil, fmt.Errorf("unknown encryption mode %q", mode)
+}
+
+// encode returns the encryption column of a file encrypted with the key
+func (k *fileKey) encode() string {
+	if k == nil {
+		return ""
+	}
+	values := url.Values{"sse": {k.mode}, "key": {k.wrapped}}
+	if k.customerKeyMD5 != "" {
+		values.Set("key-md5", k.customerKeyMD5)
+	}
+	return values.Encode()
+}
+
+// recordEncryption returns the encryption column of a record, empty for plaintext data
+func recordEncryption(record []string) string {
+	if len(record) <= encryptionColumn {
+		return ""
+	}
+	return record[encryptionColumn]
+}
+
+// encryptionMode returns the mode and the customer key md5 held by an encryption column
+func encryptionMode(encryption string) (string, string) {
+	values, err := url.ParseQuery(encryption)
+	if err != nil {
+		return "", ""
+	}
+	return values.Get("sse"), values.Get("key-md5")
+}
+
+// CustomerKeyMD5 returns the base64 encoded md5 of an SSE-C key, which the key is checked against
+func CustomerKeyMD5(customerKey []byte) string {
+	sum := md5.Sum(customerKey)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func wrapKey(kek, dataKey []byte) (string, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, dataKey, nil)), nil
+}
+
+func unwrapKey(kek []byte, wrapped string) ([]byte, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed wrapped data key")
+	}
+	dataKey, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap the data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptedSize returns the size of the file holding size bytes of encrypted content
+func encryptedSize(size int64) int64 {
+	chunks := max(1, (size+encryptionChunkSize-1)/encryptionChunkSize)
+	return size + chunks*encryptionTagSize
+}
+
+// decryptedSize returns the size of the encrypted content held by a file of fileSize bytes
+func decryptedSize(fileSize int64) int64 {
+	chunks := (fileSize + encryptionChunkSize + encryptionTagSize - 1) / (encryptionChunkSize + encryptionTagSize)
+	return fileSize - max(1, chunks)*encryptionTagSize
+}
+
+// chunkWriter encrypts what is written to it chunk by chunk, Close seals the last chunk
+type chunkWriter struct {
+	aead  cipher.AEAD
+	w     io.Writer
+	buf   []byte
+	index int64
+}
+
+func newChunkWriter(w io.Writer, dataKey []byte) (*chunkWriter, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkWriter{aead: aead, w: w, buf: make([]byte, 0, encryptionChunkSize+encryptionTagSize)}, nil
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data follows, the last one is sealed by Close
+		if len(c.buf) == encryptionChunkSize {
+			if err := c.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := min(len(p), encryptionChunkSize-len(c.buf))
+		c.buf = append(c.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (c *chunkWriter) Close() error {
+	return c.seal(true)
+}
+
+func (c *chunkWriter) seal(last bool) error {
+	sealed := c.aead.Seal(c.buf[:0], chunkNonce(c.index, last), c.buf, nil)
+	if _, err := c.w.Write(sealed); err != nil {
+		return err
+	}
+	c.buf = c.buf[:0]
+	c.index++
+	return nil
+}
+
+// chunkReader decrypts an encrypted file holding size bytes of content,
+// seeking to any offset of the content by decrypting the chunk it falls in
+type chunkReader struct {
+	aead   cipher.AEAD
+	file   *os.File
+	size   int64
+	offset int64
+	chunk  []byte
+	index  int64
+}
+
+func newChunkReader(file *os.File, dataKey []byte, size int64) (*chunkReader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{aead: aead, file: file, size: size, index: -1}, nil
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.offset >= c.size {
+		return 0, io.EOF
+	}
+
+	index := c.offset / encryptionChunkSize
+	if index != c.index {
+		length := min(encryptionChunkSize, c.size-index*encryptionChunkSize)
+		sealed := make([]byte, length+encryptionTagSize)
+		if _, err := c.file.ReadAt(sealed, index*(encryptionChunkSize+encryptionTagSize)); err != nil {
+			return 0, fmt.Errorf("failed to read chunk %d of %s: %w", index, c.file.Name(), err)
+		}
+		last := (index+1)*encryptionChunkSize >= c.size
+		chunk, err := c.aead.Open(sealed[:0], chunkNonce(index, last), sealed, nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt chunk %d of %s: %w", index, c.file.Name(), err)
+		}
+		c.chunk, c.index = chunk, index
+	}
+
+	n := copy(p, c.chunk[c.offset-index*encryptionChunkSize:])
+	c.offset += int64(n)
+	return n, nil
+}
+
+func (c *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.offset
+	case io.SeekEnd:
+		offset += c.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	c.offset = offset
+	return offset, nil
+}
+
+func (c *chunkReader) Close() error {
+	return c.file.Close()
+}
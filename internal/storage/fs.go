@@ -0,0 +1,828 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileStorage keeps every bucket in a directory under dir and the metadata in the
+// metadata store (see metaDB) under dir/.metadata: every bucket has a record (name,
+// creation time, last modified time, emptiness and versioning status) and every object
+// one with its key, size, content type, last modified time, md5, version id, delete
+// marker flag, metadata headers and encryption (see fileKey), so that a write only
+// touches the records of its key.
+//
+// The bucket locks guard the metadata of the buckets hashed to them. Object contents are
+// streamed into temporary files without holding any lock and only renamed into place,
+// together with the metadata update, while the bucket is locked
+type FileStorage struct {
+	dir  string
+	meta *metaDB
+	// masterKey wraps the data keys of SSE-S3 objects, see LoadMasterKey
+	masterKey   []byte
+	bucketLocks [bucketLockCount]sync.RWMutex
+	// dedup stores new object files in the blob store, blobMu guards the blob reference
+	// counts and files as well as the pins of the blobs whose records are being written
+	dedup    bool
+	blobMu   sync.Mutex
+	blobPins map[string]int
+	// maxObjectSize limits the size of uploaded objects when set, usage caches the usage of
+	// the buckets whose quota was checked or usage reported, guarded by usageMu
+	maxObjectSize int64
+	usageMu       sync.Mutex
+	usage         map[string]BucketUsage
+}
+
+const bucketLockCount = 64
+
+// NewFileStorage opens the storage kept under dir, creating the directory if needed,
+// importing the csv metadata of older versions and reconciling the metadata of the
+// buckets with the bucket directories found in it
+func NewFileStorage(dir string) (*FileStorage, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	meta, err := openMetaDB(dir + "/" + metadataDir + "/" + metaLogName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the metadata: %w", err)
+	}
+	s := &FileStorage{dir: dir, meta: meta}
+
+	if meta.isEmpty() {
+		err = importCSV(dir, meta)
+		if err != nil {
+			meta.close()
+			return nil, fmt.Errorf("failed to import the csv metadata: %w", err)
+		}
+	}
+
+	err = restoreBuckets(dir, meta)
+	if err != nil {
+		meta.close()
+		return nil, fmt.Errorf("failed to restore bucket metadata: %w", err)
+	}
+
+	migrated, err := migrateObjectFiles(dir, meta)
+	if err != nil {
+		meta.close()
+		return nil, fmt.Errorf("failed to migrate the object files: %w", err)
+	} else if migrated > 0 {
+		fmt.Printf("Renamed %d object files to the current layout\n", migrated)
+	}
+
+	// blobs left behind by a crash are collected before any upload can refer to them
+	removed, freed, err := s.CollectBlobs()
+	if err != nil {
+		meta.close()
+		return nil, fmt.Errorf("failed to collect unreferenced blobs: %w", err)
+	} else if removed > 0 {
+		fmt.Printf("Removed %d unreferenced blobs of %d bytes\n", removed, freed)
+	}
+	return s, nil
+}
+
+// Close releases the metadata store, which only one process can have open at a time
+func (s *FileStorage) Close() error {
+	return s.meta.close()
+}
+
+func (s *FileStorage) CreateBucket(bucketName string) error {
+	if err := ValidateBucketName(bucketName); err != nil {
+		return err
+	}
+
+	lock := s.bucketLock(bucketName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, err := s.findBucket(bucketName)
+	if err == nil {
+		return ErrBucketAlreadyExists
+	} else if !errors.Is(err, ErrNoSuchBucket) {
+		return err
+	}
+
+	// creating the bucket and storing its metadata
+	err = os.MkdirAll(s.dir+"/"+bucketName, 0o755)
+	if err != nil {
+		return err
+	}
+
+	timeNow := time.Now().Format(time.RFC850)
+	return s.meta.apply([]metaOp{{bucketIndexKey(bucketName), []string{bucketName, timeNow, timeNow, "True"}}}) // bucket name, creation time, last modified time, emptiness of a bucket
+}
+
+func (s *FileStorage) ListBuckets() ([]BucketInfo, error) {
+	var buckets []BucketInfo
+	s.meta.ascend(bucketIndexKey(""), func(_ string, record []string) bool {
+		if len(record) >= 3 {
+			buckets = append(buckets, bucketInfo(record))
+		}
+		return true
+	})
+	return buckets, nil
+}
+
+func (s *FileStorage) StatBucket(bucketName string) (BucketInfo, error) {
+	record, err := s.findBucket(bucketName)
+	if err != nil {
+		return BucketInfo{}, err
+	}
+
+	bucketDir, err := os.Open(s.dir + "/" + bucketName)
+	if err != nil {
+		return BucketInfo{}, err
+	}
+	bucketDir.Close()
+
+	return bucketInfo(record), nil
+}
+
+func (s *FileStorage) DeleteBucket(bucketName string) error {
+	lock := s.bucketLock(bucketName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	record, err := s.findBucket(bucketName)
+	if err != nil {
+		return err
+	} else if len(record) < 4 || record[3] != "True" {
+		return ErrBucketNotEmpty
+	}
+
+	// files left without records, e.g. by lost metadata, are kept until fsck gives them records back
+	hasFiles, err := hasObjectFiles(s.dir + "/" + bucketName)
+	if err != nil {
+		return err
+	} else if hasFiles {
+		return ErrBucketNotEmpty
+	}
+
+	err = removeBucketDir(s.dir + "/" + bucketName)
+	if err != nil {
+		return err
+	}
+	s.usageMu.Lock()
+	delete(s.usage, bucketName)
+	s.usageMu.Unlock()
+	return s.meta.apply([]metaOp{{key: bucketIndexKey(bucketName)}})
+}
+
+// removeBucketDir removes the directory of a bucket, uploads streaming into the bucket
+// without its lock may still add files to it until they find the directory gone
+func removeBucketDir(path string) error {
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		err = os.RemoveAll(path)
+		if !errors.Is(err, syscall.ENOTEMPTY) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *FileStorage) PutObject(bucketName, objectKey string, body io.Reader, opts PutOptions) (ObjectInfo, error) {
+	if err := ValidateObjectKey(objectKey); err != nil {
+		return ObjectInfo{}, err
+	}
+	if _, err := objectPath(s.dir, bucketName, objectKey); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	bucketRecord, err := s.findBucket(bucketName)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	key, err := s.newFileKey(opts.Encryption, opts.CustomerKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	body, err = s.limitUpload(bucketName, objectKey, 0, body)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// streaming the body into a temporary file before the bucket is locked
+	compression := bucketCompression(bucketRecord)
+	staged, err := stageObjectFile(s.dir+"/"+bucketName, body, opts.ContentMD5, key, compression)
+	if os.IsNotExist(err) {
+		// the bucket directory was removed by deleting the bucket meanwhile
+		return ObjectInfo{}, ErrNoSuchBucket
+	} else if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(staged.path)
+	contentType := staged.contentType
+	if opts.ContentType != "" {
+		contentType = opts.ContentType
+	}
+
+	lock := s.bucketLock(bucketName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bucketRecord, err = s.findBucket(bucketName)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	// deleting the bucket removed the staged file with it, even if the bucket was created again since
+	if _, err := os.Stat(staged.path); os.IsNotExist(err) {
+		return ObjectInfo{}, ErrNoSuchBucket
+	} else if err != nil {
+		return ObjectInfo{}, err
+	}
+	err = s.checkUpload(bucketRecord, objectKey, staged.size, 0)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// in a bucket with versioning enabled every upload is stored as a new version
+	versionID, filePath, err := s.newVersionPath(bucketRecord, objectKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	blob, err := s.placeObjectFile(staged, filePath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer s.releaseBlob(blob)
+
+	// preparing object metada and writing it together with the bucket metadata
+	info := ObjectInfo{
+		Key:          objectKey,
+		Size:         staged.size,
+		StoredSize:   staged.storedSize,
+		ContentType:  contentType,
+		LastModified: time.Now(),
+		ETag:         staged.eTag,
+		VersionID:    versionID,
+		IsLatest:     true,
+		Metadata:     opts.Metadata,
+	}
+	record := append(objectRecord(info), key.encode(), compression, strconv.FormatInt(staged.storedSize, 10), blob)
+	err = s.writeObjectRecord(bucketName, record)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	removeReplacedFile(s.dir+"/"+bucketName, blob, versionID, filePath)
+	info.Encryption, info.CustomerKeyMD5 = encryptionMode(record[encryptionColumn])
+	return info, nil
+}
+
+func (s *FileStorage) GetObject(bucketName, objectKey, versionID string) (ObjectInfo, io.ReadSeekCloser, error) {
+	return s.GetEncryptedObject(bucketName, objectKey, versionID, nil)
+}
+
+func (s *FileStorage) GetEncryptedObject(bucketName, objectKey, versionID string, customerKey []byte) (ObjectInfo, io.ReadSeekCloser, error) {
+	lock := s.bucketLock(bucketName)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	// the opened file keeps its content even if the object is replaced or deleted meanwhile
+	record, err := s.findObject(bucketName, objectKey, versionID)
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+
+	key, err := s.recordKey(recordEncryption(record), customerKey)
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+
+	filePath, err := recordPath(s.dir, bucketName, record)
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+
+	info := objectInfo(record)
+	content, err := openContent(file, record, key)
+	if err != nil {
+		file.Close()
+		return ObjectInfo{}, nil, err
+	}
+	return info, content, nil
+}
+
+// openContent returns the content of the opened file of an object version,
+// decrypting it with key unless that is nil and decompressing it if needed
+func openContent(file *os.File, record []string, key *fileKey) (io.ReadSeekCloser, error) {
+	var content io.ReadSeekCloser = file
+	if key != nil {
+		// the encrypted data is the content itself or its compressed form
+		decrypted, err := newChunkReader(file, key.dataKey, decryptedSize(recordStoredSize(record)))
+		if err != nil {
+			return nil, err
+		}
+		content = decrypted
+	}
+	if compression := recordCompression(record); compression != "" {
+		size, _ := strconv.ParseInt(record[1], 10, 64)
+		content = newDecompressReader(content, compression, size)
+	}
+	return content, nil
+}
+
+func (s *FileStorage) StatObject(bucketName, objectKey, versionID string) (ObjectInfo, error) {
+	lock := s.bucketLock(bucketName)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	record, err := s.findObject(bucketName, objectKey, versionID)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	filePath, err := recordPath(s.dir, bucketName, record)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	_, err = os.Stat(filePath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return objectInfo(record), nil
+}
+
+func (s *FileStorage) DeleteObject(bucketName, objectKey, versionID string) (ObjectInfo, error) {
+	lock := s.bucketLock(bucketName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bucketRecord, err := s.findBucket(bucketName)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	objectsRecords, versionRecords := s.readKeyVersions(bucketName, objectKey)
+
+	// a single object is only reported missing in a bucket which never had versioning
+	if versionID == "" && bucketVersioning(bucketRecord) == "" && len(objectsRecords) == 0 {
+		return ObjectInfo{}, ErrNoSuchKey
+	}
+
+	// the files are only removed once no metadata refers to them anymore
+	var obsolete []string
+	objectsRecords, versionRecords, deleted, err := s.applyDelete(bucketRecord, objectKey, versionID, objectsRecords, versionRecords, &obsolete)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	err = s.commitBucket(bucketRecord, s.keyVersionOps(bucketName, objectKey, objectsRecords, versionRecords))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	removeObjectFiles(s.dir+"/"+bucketName, obsolete)
+	return deleted, nil
+}
+
+func (s *FileStorage) DeleteObjects(bucketName string, objects []ObjectVersion) ([]DeleteResult, error) {
+	lock := s.bucketLock(bucketName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bucketRecord, err := s.findBucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return s.deleteVersions(bucketRecord, objects)
+}
+
+// deleteVersions deletes several objects or versions of a bucket in a single metadata
+// batch, the caller holds the bucket lock
+func (s *FileStorage) deleteVersions(bucketRecord []string, objects []ObjectVersion) ([]DeleteResult, error) {
+	bucketName := bucketRecord[0]
+
+	// the objects are deleted one after another in memory, a key listed twice seeing
+	// the result of the first delete, and the metadata is updated in a single batch
+	type keyVersions struct {
+		objectsRecords, versionRecords [][]string
+	}
+	pending := make(map[string]*keyVersions)
+	var keys []string
+
+	results := make([]DeleteResult, len(objects))
+	var obsolete []string
+	for i, object := range objects {
+		if err := ValidateObjectKey(object.Key); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if _, err := objectPath(s.dir, bucketName, object.Key); err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		versions, found := pending[object.Key]
+		if !found {
+			versions = &keyVersions{}
+			versions.objectsRecords, versions.versionRecords = s.readKeyVersions(bucketName, object.Key)
+		}
+		newObjectRecords, newVersionRecords, deleted, err := s.applyDelete(bucketRecord, object.Key, object.VersionID, versions.objectsRecords, versions.versionRecords, &obsolete)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if !found {
+			pending[object.Key] = versions
+			keys = append(keys, object.Key)
+		}
+		versions.objectsRecords, versions.versionRecords = newObjectRecords, newVersionRecords
+		results[i].Deleted = deleted
+	}
+
+	var ops []metaOp
+	for _, key := range keys {
+		ops = append(ops, s.keyVersionOps(bucketName, key, pending[key].objectsRecords, pending[key].versionRecords)...)
+	}
+	err := s.commitBucket(bucketRecord, ops)
+	if err != nil {
+		return nil, err
+	}
+	removeObjectFiles(s.dir+"/"+bucketName, obsolete)
+	return results, nil
+}
+
+func (s *FileStorage) ListObjects(bucketName string) ([]ObjectInfo, error) {
+	lock := s.bucketLock(bucketName)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if _, err := s.findBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	// the index returns the objects sorted by key
+	var objects []ObjectInfo
+	s.meta.ascend(objectIndexPrefix(bucketName), func(_ string, record []string) bool {
+		if len(record) >= 4 {
+			objects = append(objects, objectInfo(record))
+		}
+		return true
+	})
+	return objects, nil
+}
+
+func (s *FileStorage) ListObjectsPage(bucketName, prefix, startAfter string, limit int) ([]ObjectInfo, error) {
+	lock := s.bucketLock(bucketName)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if _, err := s.findBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	// keys have no control characters, so the first key after startAfter is not less than startAfter+"\x00"
+	indexPrefix := objectIndexPrefix(bucketName)
+	var objects []ObjectInfo
+	s.meta.ascendFrom(indexPrefix+prefix, indexPrefix+startAfter+"\x00", func(_ string, record []string) bool {
+		if len(objects) >= limit {
+			return false
+		}
+		if len(record) >= 4 {
+			objects = append(objects, objectInfo(record))
+		}
+		return true
+	})
+	return objects, nil
+}
+
+// bucketLock returns the lock guarding the object metadata of a bucket,
+// buckets share a fixed number of locks so that unknown names cost nothing
+func (s *FileStorage) bucketLock(bucketName string) *sync.RWMutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(bucketName))
+	return &s.bucketLocks[hash.Sum32()%bucketLockCount]
+}
+
+// findBucket returns the metadata record of a bucket
+func (s *FileStorage) findBucket(bucketName string) ([]string, error) {
+	record, found := s.meta.get(bucketIndexKey(bucketName))
+	if !found {
+		return nil, ErrNoSuchBucket
+	}
+	for len(record) < 4 {
+		record = append(record, "")
+	}
+	return record, nil
+}
+
+// updateBucket stores the record of a bucket changed by update, the caller holds the bucket lock
+func (s *FileStorage) updateBucket(bucketName string, update func(record []string) []string) error {
+	record, err := s.findBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	return s.meta.apply([]metaOp{{bucketIndexKey(bucketName), update(record)}})
+}
+
+// commitBucket applies the updates of object records together with the update of the last
+// modified time and the emptiness of their bucket, the caller holds the bucket lock
+func (s *FileStorage) commitBucket(bucketRecord []string, ops []metaOp) error {
+	record := slices.Clone(bucketRecord)
+	record[2] = time.Now().Format(time.RFC850)
+	record[3] = "False"
+	if bucketIsEmpty(s.meta, record[0], ops) {
+		record[3] = "True"
+	}
+	delta := s.usageDelta(ops)
+	err := s.applyWithBlobs(append(ops, metaOp{bucketIndexKey(record[0]), record}))
+	if err != nil {
+		return err
+	}
+	s.updateUsage(record[0], delta)
+	return nil
+}
+
+// eachReplaced calls fn with every record written by a batch of updates, nil for a deleted one,
+// and the record it replaces, nil for a new one. The caller holds the bucket lock
+func (s *FileStorage) eachReplaced(ops []metaOp, fn func(old, new []string)) {
+	replaced := make(map[string][]string)
+	for _, op := range ops {
+		old, found := replaced[op.key]
+		if !found {
+			old, _ = s.meta.get(op.key)
+		}
+		replaced[op.key] = op.record
+		fn(old, op.record)
+	}
+}
+
+// bucketIsEmpty reports whether a bucket holds no object versions once ops are applied,
+// looking at no more records than the batch deletes
+func bucketIsEmpty(meta *metaDB, bucketName string, ops []metaOp) bool {
+	prefixes := []string{objectIndexPrefix(bucketName), versionIndexPrefix(bucketName)}
+	deleted := make(map[string]bool)
+	for _, op := range ops {
+		if op.record == nil {
+			deleted[op.key] = true
+			continue
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(op.key, prefix) {
+				return false
+			}
+		}
+	}
+
+	isEmpty := true
+	for _, prefix := range prefixes {
+		meta.ascend(prefix, func(key string, _ []string) bool {
+			isEmpty = deleted[key]
+			return isEmpty
+		})
+		if !isEmpty {
+			return false
+		}
+	}
+	return true
+}
+
+// writeObjectRecord stores the record of a new current version of an object and marks
+// the bucket as not empty, updating its last modified time. In a bucket with versioning
+// the replaced record is kept as a noncurrent version
+func (s *FileStorage) writeObjectRecord(bucketName string, record []string) error {
+	bucketRecord, err := s.findBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	objectsRecords, versionRecords := s.readKeyVersions(bucketName, record[0])
+
+	// only a null version replaced by another null version is gone for good
+	var replaced []string
+	if len(objectsRecords) > 0 && (versionID(objectsRecords[0]) != "" || versionID(record) != "") {
+		replaced = objectsRecords[0]
+	}
+	versionRecords = archiveVersion(versionRecords, replaced, versionID(record))
+
+	return s.commitBucket(bucketRecord, s.keyVersionOps(bucketName, record[0], [][]string{record}, versionRecords))
+}
+
+// the keys of the metadata records: "b\x00<bucket>" for buckets, "o\x00<bucket>\x00<key>"
+// for the current versions of objects and "v\x00<bucket>\x00<key>\x00<position>" for
+// the noncurrent ones, the position ordering the versions of a key from the oldest, besides
+// the blob records and the layout record (see blobIndexKey and layoutIndexKey).
+// Neither bucket names nor object keys contain control characters
+func bucketIndexKey(bucketName string) string {
+	return "b\x00" + bucketName
+}
+
+func objectIndexPrefix(bucketName string) string {
+	return "o\x00" + bucketName + "\x00"
+}
+
+func versionIndexPrefix(bucketName string) string {
+	return "v\x00" + bucketName + "\x00"
+}
+
+func versionIndexKey(bucketName, objectKey string, position int) string {
+	return fmt.Sprintf("%s%s\x00%08x", versionIndexPrefix(bucketName), objectKey, position)
+}
+
+// stagedFile is the content of an object written to a temporary file, which is removed
+// once the file is renamed into place or the upload fails
+type stagedFile struct {
+	path string
+	// size is the size of the content and storedSize that of the file
+	size        int64
+	storedSize  int64
+	eTag        string
+	sha256      string
+	contentType string
+}
+
+// stageObjectFile streams body into a temporary file inside dir while counting and hashing it,
+// compressing it with the given algorithm unless that is empty and encrypting it with key
+// unless that is nil. The content type is sniffed from the first 512
+// bytes of the body. The ETag of SSE-C content is the md5 of the encrypted file, as the md5 of
+// the content would tell something about it to whoever does not have the key
+func stageObjectFile(dir string, body io.Reader, contentMD5 string, key *fileKey, compression string) (stagedFile, error) {
+	tmpFile, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return stagedFile{}, err
+	}
+	defer tmpFile.Close()
+	staged := stagedFile{path: tmpFile.Name()}
+
+	bufferedBody := bufio.NewReaderSize(body, 512)
+	head, err := bufferedBody.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		os.Remove(staged.path)
+		return stagedFile{}, err
+	}
+	staged.contentType = http.DetectContentType(head)
+
+	// the content is hashed as received, then compressed and encrypted on its way to the file
+	hash, fileHash, fileSHA256 := md5.New(), md5.New(), sha256.New()
+	var file io.Writer = io.MultiWriter(tmpFile, fileHash, fileSHA256)
+	var encoders []io.WriteCloser
+	if key != nil {
+		encrypter, err := newChunkWriter(file, key.dataKey)
+		if err != nil {
+			os.Remove(staged.path)
+			return stagedFile{}, err
+		}
+		file = encrypter
+		encoders = append(encoders, encrypter)
+	}
+	if compression != "" {
+		compressor, err := newCompressor(file, compression)
+		if err != nil {
+			os.Remove(staged.path)
+			return stagedFile{}, err
+		}
+		file = compressor
+		encoders = append(encoders, compressor)
+	}
+	staged.size, err = io.Copy(io.MultiWriter(file, hash), bufferedBody)
+	// the compressor is closed first so that the encrypter seals all of its output
+	for i := len(encoders) - 1; i >= 0 && err == nil; i-- {
+		err = encoders[i].Close()
+	}
+	if err == nil {
+		staged.storedSize, err = tmpFile.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if err == nil {
+		err = tmpFile.Close()
+	}
+	if err != nil {
+		os.Remove(staged.path)
+		return stagedFile{}, err
+	}
+	md5Sum := hash.Sum(nil)
+
+	if contentMD5 != "" && contentMD5 != base64.StdEncoding.EncodeToString(md5Sum) {
+		os.Remove(staged.path)
+		return stagedFile{}, ErrBadDigest
+	}
+	staged.eTag = hex.EncodeToString(md5Sum)
+	staged.sha256 = hex.EncodeToString(fileSHA256.Sum(nil))
+	if key != nil && key.mode == EncryptionCustomer {
+		staged.eTag = hex.EncodeToString(fileHash.Sum(nil))
+	}
+	return staged, nil
+}
+
+// commitObjectFile atomically renames a staged file to destination and syncs its directory,
+// so that the data is durable before the metadata pointing at it is written
+func commitObjectFile(stagedPath, destination string) error {
+	// keys with slashes are stored in nested directories
+	err := os.MkdirAll(filepath.Dir(destination), 0o755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(stagedPath, destination)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(destination))
+}
+
+// removeReplacedFile removes the file of a null version replaced by one stored as a blob,
+// which is left at the path of the null version while the records no longer refer to it
+func removeReplacedFile(bucketDir, blob, versionID, filePath string) {
+	if blob != "" && versionID == "" {
+		removeObjectFiles(bucketDir, []string{filePath})
+	}
+}
+
+// removeEmptyParents removes the directories between filePath and bucketDir
+// which became empty after the file was removed
+func removeEmptyParents(bucketDir, filePath string) {
+	for parent := filepath.Dir(filePath); parent != bucketDir && strings.HasPrefix(parent, bucketDir+"/"); parent = filepath.Dir(parent) {
+		if os.Remove(parent) != nil {
+			return
+		}
+	}
+}
+
+// removeObjectFiles removes the files of deleted object versions together with the directories
+// their keys left empty. The metadata no longer refers to them, so a file which cannot be
+// removed is only wasted space and does not fail the delete
+func removeObjectFiles(bucketDir string, filePaths []string) {
+	for _, filePath := range filePaths {
+		if err := os.Remove(filePath); err == nil || os.IsNotExist(err) {
+			removeEmptyParents(bucketDir, filePath)
+		}
+	}
+}
+
+func bucketInfo(record []string) BucketInfo {
+	info := BucketInfo{Name: record[0]}
+	info.CreationTime, _ = time.Parse(time.RFC850, record[1])
+	info.LastModified, _ = time.Parse(time.RFC850, record[2])
+	info.IsEmpty = len(record) > 3 && record[3] == "True"
+	info.Versioning = bucketVersioning(record)
+	info.Compression = bucketCompression(record)
+	info.Quota = bucketQuota(record)
+	return info
+}
+
+// objectInfo converts an object (or version) record, padding the records
+// of objects stored before the later columns were introduced
+func objectInfo(record []string) ObjectInfo {
+	for len(record) <= encryptionColumn {
+		record = append(record, "")
+	}
+	size, _ := strconv.ParseInt(record[1], 10, 64)
+	lastModified, _ := time.Parse(time.RFC850, record[3])
+
+	info := ObjectInfo{
+		Key:          record[0],
+		Size:         size,
+		ContentType:  record[2],
+		LastModified: lastModified,
+		ETag:         record[4],
+		VersionID:    record[versionIDColumn],
+		DeleteMarker: record[deleteMarkerColumn] == "True",
+	}
+	info.Encryption, info.CustomerKeyMD5 = encryptionMode(record[encryptionColumn])
+	info.StoredSize = recordStoredSize(record)
+	if metadata, err := url.ParseQuery(record[metadataColumn]); err == nil && len(metadata) > 0 {
+		info.Metadata = make(map[string]string)
+		for name := range metadata {
+			info.Metadata[name] = metadata.Get(name)
+		}
+	}
+	return info
+}
+
+// objectRecord converts object info to its object record without the columns of how it is stored,
+// the metadata headers are stored URL query encoded
+func objectRecord(info ObjectInfo) []string {
+	metadata := url.Values{}
+	for name, value := range info.Metadata {
+		metadata.Set(name, value)
+	}
+	deleteMarker := ""
+	if info.DeleteMarker {
+		deleteMarker = "True"
+	}
+	return []string{info.Key, strconv.FormatInt(info.Size, 10), info.ContentType, info.LastModified.Format(time.RFC850), info.ETag, info.VersionID, deleteMarker, metadata.Encode()}
+}
@@ -0,0 +1,559 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// importedFiles are the csv metadata files of a bucket directory, which are only read to import them
+var importedFiles = map[string]bool{
+	"objects.csv":                           true,
+	".objects.csv.imported":                 true,
+	versionsDir + "/versions.csv":           true,
+	versionsDir + "/.versions.csv.imported": true,
+}
+
+// Issue is an inconsistency between the metadata and the files of a data directory
+type Issue struct {
+	Bucket   string
+	Key      string
+	Problem  string
+	Repaired bool
+}
+
+func (i Issue) String() string {
+	location := i.Bucket
+	if i.Key != "" {
+		location += "/" + i.Key
+	}
+	if location == "" {
+		location = "metadata"
+	}
+	if i.Repaired {
+		return location + ": " + i.Problem + " (repaired)"
+	}
+	return location + ": " + i.Problem
+}
+
+// Fsck checks the bucket and object records of the metadata store against the bucket
+// directories and the files in them and reports every inconsistency. With repair the
+// metadata is rebuilt from the files: records of missing files are dropped, files without
+// records get one, sizes, ETags and content types are recalculated and the emptiness of
+// the buckets corrected, as are the reference counts of the blob store. The metadata cannot
+// be checked while a server is using it
+func Fsck(dir string, repair bool) ([]Issue, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	meta, err := openMetaDB(dir + "/" + metadataDir + "/" + metaLogName)
+	if err != nil {
+		return nil, err
+	}
+	defer meta.close()
+
+	c := &checker{store: &FileStorage{dir: dir, meta: meta}, repair: repair}
+	if _, err := os.Stat(dir + "/buckets.csv"); err == nil && meta.isEmpty() {
+		if !c.report("", "", true, "the metadata was not imported from buckets.csv yet") {
+			return c.issues, nil
+		}
+		err = importCSV(dir, meta)
+		if err != nil {
+			return c.issues, err
+		}
+	}
+
+	if record, found := meta.get(layoutIndexKey); !found || len(record) == 0 || record[0] != objectLayout {
+		if !c.report("", "", true, "the object files were not migrated to the current layout yet") {
+			return c.issues, nil
+		}
+		_, err = migrateObjectFiles(dir, meta)
+		if err != nil {
+			return c.issues, err
+		}
+	}
+
+	err = c.checkBuckets()
+	if err != nil {
+		return c.issues, err
+	}
+
+	// the reference counts of the blobs are checked against the records as repaired
+	err = c.store.checkBlobs(func(_ string, _ int64, format string, args ...any) bool {
+		return c.report("", "", true, format, args...)
+	})
+	return c.issues, err
+}
+
+type checker struct {
+	store  *FileStorage
+	repair bool
+	issues []Issue
+	// modified is set when a repair changed the records of the bucket being checked
+	modified bool
+}
+
+// report records an issue, which counts as repaired when fixes are applied and fixable is set
+func (c *checker) report(bucketName, objectKey string, fixable bool, format string, args ...any) bool {
+	repaired := c.repair && fixable
+	if repaired {
+		c.modified = true
+	}
+	c.issues = append(c.issues, Issue{Bucket: bucketName, Key: objectKey, Problem: fmt.Sprintf(format, args...), Repaired: repaired})
+	return repaired
+}
+
+func (c *checker) checkBuckets() error {
+	dir := c.store.dir
+	var ops []metaOp
+	var checkedRecords [][]string
+	known := make(map[string]bool)
+	c.store.meta.ascend(bucketIndexKey(""), func(key string, record []string) bool {
+		record = slices.Clone(record)
+		if len(record) == 0 || bucketIndexKey(record[0]) != key {
+			if c.report(strings.TrimPrefix(key, bucketIndexKey("")), "", true, "bucket record is malformed") {
+				ops = append(ops, metaOp{key: key})
+			}
+			return true
+		}
+		known[record[0]] = true
+		checkedRecords = append(checkedRecords, record)
+		return true
+	})
+
+	for i, record := range checkedRecords {
+		if err := ValidateBucketName(record[0]); err != nil {
+			c.report(record[0], "", false, "invalid bucket name: %v", err)
+			continue
+		}
+		if len(record) < 4 {
+			c.report(record[0], "", true, "record has %d of the 4 required columns", len(record))
+			for len(record) < 4 {
+				record = append(record, "")
+			}
+		}
+		for i, name := range []string{"creation", "last modified"} {
+			if _, err := time.Parse(time.RFC850, record[i+1]); err != nil && c.report(record[0], "", true, "invalid %s time %q", name, record[i+1]) {
+				record[i+1] = time.Now().Format(time.RFC850)
+			}
+		}
+		checkedRecords[i] = record
+
+		info, err := os.Stat(dir + "/" + record[0])
+		if os.IsNotExist(err) {
+			if c.report(record[0], "", true, "bucket directory is missing") {
+				err = os.MkdirAll(dir+"/"+record[0], 0o755)
+				if err != nil {
+					return err
+				}
+			}
+		} else if err != nil {
+			return err
+		} else if !info.IsDir() {
+			c.report(record[0], "", false, "bucket path is not a directory")
+		}
+	}
+
+	// directories which were left without metadata
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || known[entry.Name()] || ValidateBucketName(entry.Name()) != nil {
+			continue
+		}
+		if c.report(entry.Name(), "", true, "bucket directory has no metadata") {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			modTime := info.ModTime().Format(time.RFC850)
+			checkedRecords = append(checkedRecords, []string{entry.Name(), modTime, modTime, ""})
+		}
+	}
+
+	// temporary files left by interrupted compactions of the metadata log
+	metaEntries, err := os.ReadDir(dir + "/" + metadataDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range metaEntries {
+		if strings.HasPrefix(entry.Name(), "."+metaLogName+"-") && c.report("", "", true, "temporary file %s/%s was left behind", metadataDir, entry.Name()) {
+			err = os.Remove(dir + "/" + metadataDir + "/" + entry.Name())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, record := range checkedRecords {
+		if ValidateBucketName(record[0]) != nil {
+			continue
+		}
+		original, _ := c.store.meta.get(bucketIndexKey(record[0]))
+		if info, err := os.Stat(dir + "/" + record[0]); err == nil && info.IsDir() {
+			isEmpty, err := c.checkBucket(record[0])
+			if err != nil {
+				return err
+			}
+
+			expected := "False"
+			if isEmpty {
+				expected = "True"
+			}
+			if record[3] != expected && c.report(record[0], "", true, "empty flag is %q instead of %q", record[3], expected) {
+				record[3] = expected
+			}
+		}
+		if c.repair && !slices.Equal(original, record) {
+			ops = append(ops, metaOp{bucketIndexKey(record[0]), record})
+		}
+	}
+
+	if c.repair {
+		return c.store.meta.apply(ops)
+	}
+	return nil
+}
+
+// checkBucket checks the object and version records of a bucket against its files,
+// replacing them if anything was repaired, and reports whether the bucket holds no versions
+func (c *checker) checkBucket(bucketName string) (bool, error) {
+	c.modified = false
+
+	// the records are checked by their keys, a record stored under another key is misplaced
+	var objectsRecords, versionRecords [][]string
+	c.store.meta.ascend(objectIndexPrefix(bucketName), func(key string, record []string) bool {
+		if len(record) == 0 || objectIndexPrefix(bucketName)+record[0] != key {
+			c.report(bucketName, strings.TrimPrefix(key, objectIndexPrefix(bucketName)), true, "object record is stored under another key")
+		}
+		objectsRecords = append(objectsRecords, slices.Clone(record))
+		return true
+	})
+	c.store.meta.ascend(versionIndexPrefix(bucketName), func(key string, record []string) bool {
+		if len(record) == 0 || !strings.HasPrefix(key, versionIndexPrefix(bucketName)+record[0]+"\x00") {
+			c.report(bucketName, "", true, "version record %q is stored under another key", strings.TrimPrefix(key, versionIndexPrefix(bucketName)))
+		}
+		versionRecords = append(versionRecords, slices.Clone(record))
+		return true
+	})
+	// without repairs the empty flag is compared with what the metadata currently says
+	isEmpty := len(objectsRecords) == 0 && len(versionRecords) == 0
+
+	referenced, replaced := make(map[string]bool), make(map[string]bool)
+	objectsRecords = c.checkRecords(bucketName, objectsRecords, false, referenced, replaced)
+	versionRecords = c.checkRecords(bucketName, versionRecords, true, referenced, replaced)
+
+	objectsRecords, versionRecords, err := c.checkFiles(bucketName, objectsRecords, versionRecords, referenced, replaced)
+	if err != nil {
+		return false, err
+	}
+
+	// a key without a current version whose newest noncurrent version holds data
+	// lost its current record, the version is promoted as a delete would do
+	current := make(map[string]bool)
+	for _, record := range objectsRecords {
+		current[record[0]] = true
+	}
+	for i := len(versionRecords) - 1; i >= 0; i-- {
+		record := versionRecords[i]
+		if current[record[0]] {
+			continue
+		}
+		current[record[0]] = true
+		if !isDeleteMarker(record) && c.report(bucketName, record[0], true, "object has no current version although version %s is the newest one", DisplayVersionID(versionID(record))) {
+			objectsRecords = append(objectsRecords, versionRecord(record, false))
+			versionRecords = append(versionRecords[:i], versionRecords[i+1:]...)
+		}
+	}
+
+	if c.modified {
+		err = c.replaceRecords(bucketName, objectsRecords, versionRecords)
+		if err != nil {
+			return false, err
+		}
+	}
+	if c.repair {
+		isEmpty = len(objectsRecords) == 0 && len(versionRecords) == 0
+	}
+	return isEmpty, nil
+}
+
+// replaceRecords replaces all object and version records of a bucket in a single batch,
+// the versions of every key keeping their order
+func (c *checker) replaceRecords(bucketName string, objectsRecords, versionRecords [][]string) error {
+	var ops []metaOp
+	for _, prefix := range []string{objectIndexPrefix(bucketName), versionIndexPrefix(bucketName)} {
+		c.store.meta.ascend(prefix, func(key string, _ []string) bool {
+			ops = append(ops, metaOp{key: key})
+			return true
+		})
+	}
+	for _, record := range objectsRecords {
+		ops = append(ops, metaOp{objectIndexPrefix(bucketName) + record[0], record})
+	}
+	positions := make(map[string]int)
+	for _, record := range versionRecords {
+		ops = append(ops, metaOp{versionIndexKey(bucketName, record[0], positions[record[0]]), record})
+		positions[record[0]]++
+	}
+	return c.store.meta.apply(ops)
+}
+
+// checkRecords checks every object record (or version record if noncurrent is set) against
+// the file holding its data and returns the records which are kept, marking their files as referenced
+// and, for versions kept in the blob store, the path their own file would have as replaced
+func (c *checker) checkRecords(bucketName string, records [][]string, noncurrent bool, referenced, replaced map[string]bool) [][]string {
+	kind := "object"
+	if noncurrent {
+		kind = "version"
+	}
+
+	var checkedRecords [][]string
+	seen := make(map[string]bool)
+	for _, record := range records {
+		if len(record) < 4 || record[0] == "" {
+			c.report(bucketName, "", true, "malformed %s record: %q", kind, strings.Join(record, ","))
+			continue
+		}
+		objectKey := record[0]
+		if err := ValidateObjectKey(objectKey); err != nil {
+			c.report(bucketName, objectKey, true, "invalid object key in a %s record: %v", kind, err)
+			continue
+		}
+
+		// there is a single current record per key and a single record per version
+		id := objectKey
+		if noncurrent {
+			id += "\x00" + versionID(record)
+		}
+		if seen[id] {
+			c.report(bucketName, objectKey, true, "version %s has more than one %s record", DisplayVersionID(versionID(record)), kind)
+			continue
+		}
+		seen[id] = true
+
+		if isDeleteMarker(record) {
+			if !noncurrent {
+				c.report(bucketName, objectKey, false, "delete marker %s is stored as the current version", DisplayVersionID(versionID(record)))
+			}
+			checkedRecords = append(checkedRecords, record)
+			continue
+		}
+
+		filePath, err := recordPath(c.store.dir, bucketName, record)
+		if err != nil {
+			c.report(bucketName, objectKey, true, "version %s cannot be stored: %v", DisplayVersionID(versionID(record)), err)
+			continue
+		}
+		info, err := os.Stat(filePath)
+		if err != nil || !info.Mode().IsRegular() {
+			c.report(bucketName, objectKey, true, "data of version %s is missing", DisplayVersionID(versionID(record)))
+			continue
+		}
+		referenced[filePath] = true
+		if recordBlob(record) != "" {
+			// without its blob column the record maps to the file the version would have of its own
+			if ownPath, err := recordPath(c.store.dir, bucketName, record[:blobColumn]); err == nil {
+				replaced[ownPath] = true
+			}
+		}
+
+		size, err := strconv.ParseInt(record[1], 10, 64)
+		if recordEncryption(record) != "" || recordCompression(record) != "" {
+			// the content of an encrypted version cannot be rescanned without its key, nor is a compressed one
+			if storedSize := recordStoredSize(record); err != nil || storedSize != info.Size() {
+				c.report(bucketName, objectKey, false, "stored size is %d in the metadata but the file has %d bytes", storedSize, info.Size())
+			}
+		} else if err != nil || size != info.Size() {
+			if c.report(bucketName, objectKey, true, "size is %q in the metadata but the file has %d bytes", record[1], info.Size()) {
+				record = c.rescanRecord(bucketName, record, filePath)
+			}
+		} else if record[2] == "" {
+			if c.report(bucketName, objectKey, true, "content type is missing") {
+				record = c.rescanRecord(bucketName, record, filePath)
+			}
+		}
+		if _, err := time.Parse(time.RFC850, record[3]); err != nil && c.report(bucketName, objectKey, true, "invalid last modified time %q", record[3]) {
+			record[3] = info.ModTime().Format(time.RFC850)
+		}
+		checkedRecords = append(checkedRecords, record)
+	}
+	return checkedRecords
+}
+
+// rescanRecord recalculates the size and ETag of a record from its file,
+// as well as the content type if the record has none
+func (c *checker) rescanRecord(bucketName string, record []string, filePath string) []string {
+	scanned, err := scanObjectFile(filePath)
+	if err != nil {
+		c.report(bucketName, record[0], false, "data of version %s cannot be read: %v", DisplayVersionID(versionID(record)), err)
+		return record
+	}
+	for len(record) <= metadataColumn {
+		record = append(record, "")
+	}
+	record[1] = strconv.FormatInt(scanned.Size, 10)
+	record[4] = scanned.ETag
+	if len(record) > storedSizeColumn {
+		record[storedSizeColumn] = record[1]
+	}
+	if record[2] == "" {
+		record[2] = scanned.ContentType
+	}
+	return record
+}
+
+// checkFiles walks the bucket directory looking for files which no record refers to:
+// object and version files get records built from their contents, while temporary files
+// left by interrupted writes are removed, as are the files of versions which moved to the
+// blob store. Multipart uploads in progress are not checked
+func (c *checker) checkFiles(bucketName string, objectsRecords, versionRecords [][]string, referenced, replaced map[string]bool) ([][]string, [][]string, error) {
+	bucketDir := c.store.dir + "/" + bucketName
+	current := make(map[string]bool)
+	for _, record := range objectsRecords {
+		current[record[0]] = true
+	}
+
+	err := filepath.WalkDir(bucketDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath := strings.TrimPrefix(filePath, bucketDir+"/")
+		if filePath == bucketDir || importedFiles[relativePath] {
+			return nil
+		}
+		if entry.IsDir() {
+			if relativePath == multipartDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if referenced[filePath] {
+			return nil
+		}
+
+		name := entry.Name()
+		if isTemporaryFile(name) {
+			if c.report(bucketName, "", true, "temporary file %s was left behind", relativePath) {
+				return os.Remove(filePath)
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			c.report(bucketName, "", false, "unexpected file %s", relativePath)
+			return nil
+		}
+		if replaced[filePath] {
+			if c.report(bucketName, "", true, "file %s of a version stored as a blob was left behind", relativePath) {
+				return os.Remove(filePath)
+			}
+			return nil
+		}
+
+		// object files keep their escaped key as the path, version files are
+		// named after their version id in a directory named after the key
+		objectKey, id := "", ""
+		if keyPath, found := strings.CutPrefix(relativePath, versionsDir+"/"); found {
+			if !strings.HasPrefix(name, ".") || len(name) == 1 {
+				c.report(bucketName, "", false, "unexpected file %s", relativePath)
+				return nil
+			}
+			objectKey, err = objectKeyFromPath(filepath.Dir(keyPath))
+			id = name[1:]
+			if err == nil {
+				var expected string
+				expected, err = versionPath(c.store.dir, bucketName, objectKey, id)
+				if err == nil && expected != filePath {
+					err = errors.New("path does not match the key")
+				}
+			}
+		} else {
+			objectKey, err = objectKeyFromPath(strings.TrimSuffix(relativePath, objectFileSuffix))
+			if err == nil {
+				var expected string
+				expected, err = objectPath(c.store.dir, bucketName, objectKey)
+				if err == nil && expected != filePath {
+					err = errors.New("path does not match the key")
+				}
+			}
+		}
+		if err == nil {
+			err = ValidateObjectKey(objectKey)
+		}
+		if err != nil {
+			c.report(bucketName, "", false, "unexpected file %s: %v", relativePath, err)
+			return nil
+		}
+
+		if !c.report(bucketName, objectKey, true, "version %s has no metadata", DisplayVersionID(id)) {
+			return nil
+		}
+		scanned, err := scanObjectFile(filePath)
+		if err != nil {
+			return err
+		}
+		scanned.Key = objectKey
+		scanned.VersionID = id
+
+		// the file becomes the current version of its key unless there already is one,
+		// otherwise it is kept as the oldest noncurrent version
+		if !current[objectKey] {
+			current[objectKey] = true
+			objectsRecords = append(objectsRecords, objectRecord(scanned))
+		} else {
+			versionRecords = append([][]string{objectRecord(scanned)}, versionRecords...)
+		}
+		return nil
+	})
+	return objectsRecords, versionRecords, err
+}
+
+// isTemporaryFile reports whether a file of a bucket directory is a temporary file being written
+func isTemporaryFile(name string) bool {
+	return strings.HasPrefix(name, ".upload-") || strings.HasPrefix(name, ".objects.csv-") || strings.HasPrefix(name, ".versions.csv-")
+}
+
+// scanObjectFile returns the size, md5 ETag, sniffed content type
+// and modification time of the file holding an object version
+func scanObjectFile(filePath string) (ObjectInfo, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return ObjectInfo{}, err
+	}
+
+	hash := md5.New()
+	hash.Write(head[:n])
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Size:         int64(n) + size,
+		ContentType:  http.DetectContentType(head[:n]),
+		LastModified: stat.ModTime(),
+		ETag:         hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
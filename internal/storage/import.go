@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// importCSV moves the metadata kept by older versions in csv files into the metadata store:
+// buckets.csv with a row per bucket and, in every bucket directory, objects.csv with the
+// current versions of its objects and .versions/versions.csv with the noncurrent ones from the
+// oldest. The object records of every bucket directory are imported, listed in buckets.csv or
+// not, as older versions could truncate it; restoreBuckets adds the missing bucket records.
+// The records are written as one compacted log, and only once it is durable are the csv files
+// renamed aside (with a leading dot and an .imported suffix), so an interrupted import is
+// simply run again on the next start
+func importCSV(dir string, meta *metaDB) error {
+	bucketRecords, err := readCSV(dir + "/buckets.csv")
+	if err != nil {
+		return fmt.Errorf("failed to read buckets.csv: %w", err)
+	}
+
+	var ops []metaOp
+	var imported []string
+	if bucketRecords != nil {
+		imported = append(imported, dir+"/buckets.csv")
+	}
+	var bucketNames []string
+	known := make(map[string]bool)
+	for _, bucketRecord := range bucketRecords {
+		if len(bucketRecord) == 0 || known[bucketRecord[0]] || ValidateBucketName(bucketRecord[0]) != nil {
+			continue
+		}
+		known[bucketRecord[0]] = true
+		bucketNames = append(bucketNames, bucketRecord[0])
+		for len(bucketRecord) < 4 {
+			bucketRecord = append(bucketRecord, "")
+		}
+		ops = append(ops, metaOp{bucketIndexKey(bucketRecord[0]), bucketRecord})
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read the directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && !known[entry.Name()] && ValidateBucketName(entry.Name()) == nil {
+			known[entry.Name()] = true
+			bucketNames = append(bucketNames, entry.Name())
+		}
+	}
+
+	for _, bucketName := range bucketNames {
+		// only the first row of a key was ever read, later duplicates are dropped
+		objectsPath := dir + "/" + bucketName + "/objects.csv"
+		objectsRecords, err := readCSV(objectsPath)
+		if err != nil {
+			return fmt.Errorf("failed to read objects.csv of %s: %w", bucketName, err)
+		}
+		current := make(map[string]bool)
+		for _, record := range objectsRecords {
+			if len(record) < 4 || current[record[0]] {
+				continue
+			}
+			current[record[0]] = true
+			ops = append(ops, metaOp{objectIndexPrefix(bucketName) + record[0], record})
+		}
+
+		versionsFile := versionsPath(dir, bucketName)
+		versionRecords, err := readCSV(versionsFile)
+		if err != nil {
+			return fmt.Errorf("failed to read versions.csv of %s: %w", bucketName, err)
+		}
+		positions := make(map[string]int)
+		for _, record := range versionRecords {
+			if len(record) < 4 {
+				continue
+			}
+			ops = append(ops, metaOp{versionIndexKey(bucketName, record[0], positions[record[0]]), record})
+			positions[record[0]]++
+		}
+
+		if objectsRecords != nil {
+			imported = append(imported, objectsPath)
+		}
+		if versionRecords != nil {
+			imported = append(imported, versionsFile)
+		}
+	}
+	if len(imported) == 0 {
+		return nil
+	}
+
+	err = meta.load(ops)
+	if err != nil {
+		return err
+	}
+
+	for _, csvPath := range imported {
+		err = os.Rename(csvPath, importedPath(csvPath))
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Imported the metadata of %d csv files\n", len(imported))
+	return nil
+}
+
+// importedPath returns the name an imported csv file is renamed to, no object can be
+// stored under it since object paths never start with a dot
+func importedPath(csvPath string) string {
+	return filepath.Dir(csvPath) + "/." + filepath.Base(csvPath) + ".imported"
+}
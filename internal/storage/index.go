@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"math/rand/v2"
+	"strings"
+)
+
+// maxIndexLevel bounds the height of the skip list, with a quarter of the nodes
+// promoted at every level it stays balanced well beyond a billion entries
+const maxIndexLevel = 16
+
+// metaIndex is the in-memory part of the metadata store: a skip list of records
+// ordered by key, giving logarithmic lookups and updates and ordered iteration
+type metaIndex struct {
+	head   indexNode
+	level  int
+	length int
+}
+
+type indexNode struct {
+	key    string
+	record []string
+	next   []*indexNode
+}
+
+func newMetaIndex() *metaIndex {
+	return &metaIndex{head: indexNode{next: make([]*indexNode, maxIndexLevel)}, level: 1}
+}
+
+// seek returns the first node with a key not less than key, filling path with
+// the last node before it on every level when path is not nil
+func (x *metaIndex) seek(key string, path *[maxIndexLevel]*indexNode) *indexNode {
+	node := &x.head
+	for level := x.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < key {
+			node = node.next[level]
+		}
+		if path != nil {
+			path[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+func (x *metaIndex) get(key string) ([]string, bool) {
+	node := x.seek(key, nil)
+	if node == nil || node.key != key {
+		return nil, false
+	}
+	return node.record, true
+}
+
+// set stores record under key and returns the record it replaced, if any
+func (x *metaIndex) set(key string, record []string) ([]string, bool) {
+	var path [maxIndexLevel]*indexNode
+	node := x.seek(key, &path)
+	if node != nil && node.key == key {
+		replaced := node.record
+		node.record = record
+		return replaced, true
+	}
+
+	level := 1
+	for level < maxIndexLevel && rand.Uint32()&3 == 0 {
+		level++
+	}
+	for ; x.level < level; x.level++ {
+		path[x.level] = &x.head
+	}
+
+	node = &indexNode{key: key, record: record, next: make([]*indexNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = path[i].next[i]
+		path[i].next[i] = node
+	}
+	x.length++
+	return nil, false
+}
+
+// delete removes key and returns the record it held, if any
+func (x *metaIndex) delete(key string) ([]string, bool) {
+	var path [maxIndexLevel]*indexNode
+	node := x.seek(key, &path)
+	if node == nil || node.key != key {
+		return nil, false
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		path[i].next[i] = node.next[i]
+	}
+	for x.level > 1 && x.head.next[x.level-1] == nil {
+		x.level--
+	}
+	x.length--
+	return node.record, true
+}
+
+// ascend calls fn for every key starting with prefix in ascending order until fn returns false
+func (x *metaIndex) ascend(prefix string, fn func(key string, record []string) bool) {
+	x.ascendFrom(prefix, prefix, fn)
+}
+
+// ascendFrom calls fn for every key starting with prefix and not less than from in
+// ascending order until fn returns false
+func (x *metaIndex) ascendFrom(prefix, from string, fn func(key string, record []string) bool) {
+	for node := x.seek(max(prefix, from), nil); node != nil && strings.HasPrefix(node.key, prefix); node = node.next[0] {
+		if !fn(node.key, node.record) {
+			return
+		}
+	}
+}
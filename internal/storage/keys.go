@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxObjectKeyLength = 1024
+
+// names inside a bucket directory which can never be used by an object file
+var reservedNames = map[string]bool{
+	"objects.csv": true,
+}
+
+var ipv4Pattern = regexp.MustCompile(`^((25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)$`)
+
+// ValidateBucketName checks a bucket name against the S3 naming rules:
+// 3-63 chars of lowercase letters, digits, hyphens and dots, no leading or
+// trailing hyphen or dot, no consecutive periods or dashes and no IPv4 formatting
+func ValidateBucketName(name string) error {
+	if name == "" {
+		return &InvalidBucketNameError{"Bucket name is required"}
+	} else if len(name) < 3 || len(name) > 63 {
+		return &InvalidBucketNameError{"Incorrect bucket name length: must be between 3-63 chars"}
+	} else if name[0] == '-' || name[len(name)-1] == '-' {
+		return &InvalidBucketNameError{"Must not begin or end with a hyphen"}
+	} else if name[0] == '.' || name[len(name)-1] == '.' {
+		return &InvalidBucketNameError{"Must begin and end with a letter or number"}
+	}
+
+	for idx, ch := range name {
+		if !((ch >= 97 && ch <= 122) || (ch >= 48 && ch <= 57) || (ch == '-') || (ch == '.')) {
+			return &InvalidBucketNameError{"Forbidden rune is used in Bucket name"}
+		} else if idx <= (len(name) - 2) {
+			if ch == '.' && name[idx+1] == '.' {
+				return &InvalidBucketNameError{"Two consecutive periods are not allowed"}
+			} else if ch == '-' && name[idx+1] == '-' {
+				return &InvalidBucketNameError{"Two consecutive dashes are not allowed"}
+			}
+		}
+	}
+
+	if ipv4Pattern.MatchString(name) {
+		return &InvalidBucketNameError{"Bucket name is formatted as IPv4"}
+	}
+
+	return nil
+}
+
+// ValidateObjectKey checks that an object key follows the S3 rules:
+// 1 to 1024 bytes of valid UTF-8, here without control characters
+func ValidateObjectKey(objectKey string) error {
+	if objectKey == "" {
+		return &InvalidKeyError{"Object key is required"}
+	} else if len(objectKey) > maxObjectKeyLength {
+		return ErrKeyTooLong
+	} else if !utf8.ValidString(objectKey) {
+		return &InvalidKeyError{"Object key must be valid UTF-8"}
+	}
+
+	for _, ch := range objectKey {
+		if ch < 0x20 || ch == 0x7f {
+			return &InvalidKeyError{"Object key must not contain control characters"}
+		}
+	}
+	return nil
+}
+
+// objectFileSuffix ends the name of the file of an object. Escaped segments never end with
+// a lone '%', so the file of the key "a" ("a%") and the directory of the key "a/b" can both
+// exist. Data directories of older versions are migrated to it by migrateObjectFiles
+const objectFileSuffix = "%"
+
+// objectPath maps an object key to the path of its file inside the bucket directory:
+// the path of the key (see keyPath) followed by objectFileSuffix
+func objectPath(dir, bucketName, objectKey string) (string, error) {
+	keyPath, err := keyPath(dir, bucketName, objectKey)
+	if err != nil {
+		return "", err
+	} else if len(filepath.Base(keyPath)) >= 255 {
+		return "", ErrKeyTooLong
+	}
+	return keyPath + objectFileSuffix, nil
+}
+
+// keyPath maps an object key to a path inside the bucket directory. Every slash separated
+// segment of the key becomes a directory level and is escaped so that it can never leave
+// the bucket directory or clash with the metadata: '%' and '\' are percent-encoded, as is
+// a leading '.' (so "." and ".." are impossible, leaving dot names to the server) and the
+// first letter of a reserved top level name. An empty segment, e.g. the end of the folder
+// marker "photos/", is stored as "%00"
+func keyPath(dir, bucketName, objectKey string) (string, error) {
+	segments := strings.Split(objectKey, "/")
+	for i, segment := range segments {
+		segments[i] = escapeSegment(segment, i == 0)
+		if len(segments[i]) > 255 {
+			return "", ErrKeyTooLong
+		}
+	}
+	return dir + "/" + bucketName + "/" + strings.Join(segments, "/"), nil
+}
+
+// objectKeyFromPath reverses keyPath for a path relative to the bucket directory
+func objectKeyFromPath(relativePath string) (string, error) {
+	segments := strings.Split(relativePath, "/")
+	for i, segment := range segments {
+		if segment == "%00" {
+			segments[i] = ""
+			continue
+		}
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", err
+		}
+		segments[i] = unescaped
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+func escapeSegment(segment string, topLevel bool) string {
+	if segment == "" {
+		return "%00"
+	}
+
+	var escaped strings.Builder
+	for i := 0; i < len(segment); i++ {
+		ch := segment[i]
+		if ch == '%' || ch == '\\' || (i == 0 && (ch == '.' || (topLevel && reservedNames[segment]))) {
+			fmt.Fprintf(&escaped, "%%%02X", ch)
+		} else {
+			escaped.WriteByte(ch)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,394 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the lifecycle rules of a bucket are kept in the seventh column of its record, every rule
+// URL query encoded and the encoded rules in turn as the "rule" values of a query. As on S3
+// an object expires at the first midnight UTC after the number of days of a rule have passed
+// since it was written, a noncurrent version counting from when the next one was written
+const bucketLifecycleColumn = 6
+
+func (s *FileStorage) SetLifecycle(bucketName string, rules []LifecycleRule) error {
+	lock := s.bucketLock(bucketName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := s.findBucket(bucketName); err != nil {
+		return err
+	}
+
+	return s.updateBucket(bucketName, func(record []string) []string {
+		for len(record) <= bucketLifecycleColumn {
+			record = append(record, "")
+		}
+		record[bucketLifecycleColumn] = encodeLifecycle(rules)
+		return record
+	})
+}
+
+func (s *FileStorage) Lifecycle(bucketName string) ([]LifecycleRule, error) {
+	lock := s.bucketLock(bucketName)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	record, err := s.findBucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLifecycle(bucketLifecycle(record))
+}
+
+func (s *FileStorage) ApplyLifecycle(now time.Time) (int, error) {
+	var bucketNames []string
+	s.meta.ascend(bucketIndexKey(""), func(_ string, record []string) bool {
+		if bucketLifecycle(record) != "" {
+			bucketNames = append(bucketNames, record[0])
+		}
+		return true
+	})
+
+	// a bucket failing to expire does not keep the other ones from expiring
+	expired := 0
+	var errs []error
+	for _, bucketName := range bucketNames {
+		deleted, err := s.expireBucket(bucketName, now)
+		expired += deleted
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bucket %s: %w", bucketName, err))
+		}
+	}
+	return expired, errors.Join(errs...)
+}
+
+// expireBatchKeys bounds the number of keys whose versions are checked while the bucket is locked
+const expireBatchKeys = 1000
+
+// expireBucket deletes the object versions and aborts the multipart uploads of a bucket
+// which its rules expire. The keys are checked in batches with the bucket read locked,
+// and the versions found expired are checked again and deleted with it write locked, so
+// that neither the bucket nor the buckets sharing its lock are blocked for the whole scan
+// and nothing written meanwhile is mistaken for what expired
+func (s *FileStorage) expireBucket(bucketName string, now time.Time) (int, error) {
+	lock := s.bucketLock(bucketName)
+	deleted := 0
+	for after, done := "", false; !done; {
+		var candidates []string
+		lock.RLock()
+		bucketRecord, err := s.findBucket(bucketName)
+		if err != nil {
+			lock.RUnlock()
+			return deleted, err
+		}
+		rules, err := decodeLifecycle(bucketLifecycle(bucketRecord))
+		if err != nil {
+			lock.RUnlock()
+			return deleted, err
+		}
+		var keys []string
+		keys, done = s.nextKeys(bucketName, "", after, expireBatchKeys)
+		for _, objectKey := range keys {
+			if keyRules := matchingRules(rules, objectKey); len(keyRules) > 0 {
+				objectsRecords, versionRecords := s.readKeyVersions(bucketName, objectKey)
+				if len(expiredVersions(keyRules, objectKey, objectsRecords, versionRecords, now)) > 0 {
+					candidates = append(candidates, objectKey)
+				}
+			}
+		}
+		lock.RUnlock()
+		if len(keys) > 0 {
+			after = keys[len(keys)-1]
+		}
+
+		if len(candidates) > 0 {
+			expired, err := s.expireKeys(bucketName, candidates, now)
+			deleted += expired
+			if err != nil {
+				return deleted, err
+			}
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	bucketRecord, err := s.findBucket(bucketName)
+	if err != nil {
+		return deleted, err
+	}
+	rules, err := decodeLifecycle(bucketLifecycle(bucketRecord))
+	if err != nil {
+		return deleted, err
+	}
+	aborted, err := s.abortExpiredUploads(bucketName, rules, now)
+	return deleted + aborted, err
+}
+
+// expireKeys deletes the versions of the given keys which are expired by the rules of the
+// bucket as they are once it is locked, committed as a single batch
+func (s *FileStorage) expireKeys(bucketName string, keys []string, now time.Time) (int, error) {
+	lock := s.bucketLock(bucketName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bucketRecord, err := s.findBucket(bucketName)
+	if err != nil {
+		return 0, err
+	}
+	rules, err := decodeLifecycle(bucketLifecycle(bucketRecord))
+	if err != nil {
+		return 0, err
+	}
+
+	var expired []ObjectVersion
+	for _, objectKey := range keys {
+		if keyRules := matchingRules(rules, objectKey); len(keyRules) > 0 {
+			objectsRecords, versionRecords := s.readKeyVersions(bucketName, objectKey)
+			expired = append(expired, expiredVersions(keyRules, objectKey, objectsRecords, versionRecords, now)...)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	results, err := s.deleteVersions(bucketRecord, expired)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, result := range results {
+		if result.Err == nil {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// nextKeys returns in ascending order the first limit keys starting with prefix after the given
+// one which have a current or noncurrent version, and whether there are no more. The caller
+// holds the bucket lock
+func (s *FileStorage) nextKeys(bucketName, prefix, after string, limit int) ([]string, bool) {
+	// the version records of a key are stored under "<key>\x00<position>", "<key>\x01" sorts after them
+	var objectKeys, versionKeys []string
+	objectsFrom, versionsFrom := objectIndexPrefix(bucketName), versionIndexPrefix(bucketName)
+	if after != "" {
+		objectsFrom += after + "\x00"
+		versionsFrom += after + "\x01"
+	}
+	s.meta.ascendFrom(objectIndexPrefix(bucketName)+prefix, objectsFrom, func(_ string, record []string) bool {
+		if len(record) >= 4 {
+			objectKeys = append(objectKeys, record[0])
+		}
+		return len(objectKeys) < limit
+	})
+	s.meta.ascendFrom(versionIndexPrefix(bucketName)+prefix, versionsFrom, func(_ string, record []string) bool {
+		if len(record) >= 4 && (len(versionKeys) == 0 || versionKeys[len(versionKeys)-1] != record[0]) {
+			versionKeys = append(versionKeys, record[0])
+		}
+		return len(versionKeys) < limit
+	})
+
+	// the first keys of both lists are all the keys up to the limit: a key missing from a
+	// list which is full sorts after every key in it
+	keys := append(objectKeys, versionKeys...)
+	sort.Strings(keys)
+	keys = slices.Compact(keys)
+	if len(keys) > limit {
+		return keys[:limit], false
+	}
+	return keys, len(objectKeys) < limit && len(versionKeys) < limit
+}
+
+// matchingRules returns the enabled rules whose prefix the key starts with
+func matchingRules(rules []LifecycleRule, objectKey string) []LifecycleRule {
+	var matching []LifecycleRule
+	for _, rule := range rules {
+		if rule.Enabled && strings.HasPrefix(objectKey, rule.Prefix) {
+			matching = append(matching, rule)
+		}
+	}
+	return matching
+}
+
+// expiredVersions returns the versions of an object which the rules matching its key expire:
+// the current version, the noncurrent ones, and a delete marker on top of versions which
+// all expire. Delete markers are stored as noncurrent versions even when they are the newest
+func expiredVersions(rules []LifecycleRule, objectKey string, objectsRecords, versionRecords [][]string, now time.Time) []ObjectVersion {
+	var expired []ObjectVersion
+	latestMarker := -1
+	if len(objectsRecords) == 0 && len(versionRecords) > 0 && isDeleteMarker(versionRecords[len(versionRecords)-1]) {
+		latestMarker = len(versionRecords) - 1
+	}
+
+	for i, record := range versionRecords {
+		if i == latestMarker {
+			continue
+		}
+		// a version became noncurrent when the next newer one was written
+		next := record
+		if i+1 < len(versionRecords) {
+			next = versionRecords[i+1]
+		} else if len(objectsRecords) > 0 {
+			next = objectsRecords[0]
+		}
+		noncurrentSince, err := time.Parse(time.RFC850, next[3])
+		if err != nil {
+			continue
+		}
+		for _, rule := range rules {
+			if rule.NoncurrentDays > 0 && !now.Before(expirationTime(noncurrentSince, rule.NoncurrentDays)) {
+				expired = append(expired, ObjectVersion{Key: objectKey, VersionID: DisplayVersionID(versionID(record))})
+				break
+			}
+		}
+	}
+
+	if len(objectsRecords) > 0 {
+		record := objectsRecords[0]
+		if lastModified, err := time.Parse(time.RFC850, record[3]); err == nil && !isDeleteMarker(record) {
+			for _, rule := range rules {
+				if rule.expiresCurrent(lastModified, now) {
+					expired = append(expired, ObjectVersion{Key: objectKey})
+					break
+				}
+			}
+		}
+	} else if latestMarker >= 0 && len(expired) == latestMarker {
+		for _, rule := range rules {
+			if rule.ExpiredObjectDeleteMarker {
+				expired = append(expired, ObjectVersion{Key: objectKey, VersionID: DisplayVersionID(versionID(versionRecords[latestMarker]))})
+				break
+			}
+		}
+	}
+	return expired
+}
+
+// abortExpiredUploads removes the multipart uploads of a bucket which the rules abort,
+// the caller holds the bucket lock
+func (s *FileStorage) abortExpiredUploads(bucketName string, rules []LifecycleRule, now time.Time) (int, error) {
+	entries, err := os.ReadDir(s.dir + "/" + bucketName + "/" + multipartDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	aborted := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || !uploadIDPattern.MatchString(entry.Name()) {
+			continue
+		}
+		uploadPath := s.uploadDir(bucketName, entry.Name())
+		records, err := readCSV(uploadPath + "/upload.csv")
+		if err != nil || len(records) == 0 || len(records[0]) < 2 {
+			continue
+		}
+		initiated, err := time.Parse(time.RFC850, records[0][1])
+		if err != nil {
+			continue
+		}
+
+		for _, rule := range rules {
+			if rule.Enabled && rule.AbortMultipartDays > 0 && strings.HasPrefix(records[0][0], rule.Prefix) && !now.Before(expirationTime(initiated, rule.AbortMultipartDays)) {
+				if err := s.removeUpload(bucketName, entry.Name()); err != nil {
+					return aborted, err
+				}
+				aborted++
+				break
+			}
+		}
+	}
+	return aborted, nil
+}
+
+// expiresCurrent reports whether the rule expires a current version written at lastModified
+func (r LifecycleRule) expiresCurrent(lastModified, now time.Time) bool {
+	if !r.ExpirationDate.IsZero() && !now.Before(r.ExpirationDate) {
+		return true
+	}
+	return r.ExpirationDays > 0 && !now.Before(expirationTime(lastModified, r.ExpirationDays))
+}
+
+// expirationTime returns the first midnight UTC once the given number of days passed since t
+func expirationTime(t time.Time, days int) time.Time {
+	expiration := t.UTC().AddDate(0, 0, days)
+	if midnight := expiration.Truncate(24 * time.Hour); !midnight.Equal(expiration) {
+		return midnight.AddDate(0, 0, 1)
+	}
+	return expiration
+}
+
+func bucketLifecycle(record []string) string {
+	if len(record) <= bucketLifecycleColumn {
+		return ""
+	}
+	return record[bucketLifecycleColumn]
+}
+
+func encodeLifecycle(rules []LifecycleRule) string {
+	encoded := url.Values{}
+	for _, rule := range rules {
+		values := url.Values{"id": {rule.ID}, "prefix": {rule.Prefix}}
+		if rule.Enabled {
+			values.Set("enabled", "true")
+		}
+		if rule.ExpirationDays > 0 {
+			values.Set("days", strconv.Itoa(rule.ExpirationDays))
+		}
+		if !rule.ExpirationDate.IsZero() {
+			values.Set("date", rule.ExpirationDate.UTC().Format(time.RFC3339))
+		}
+		if rule.ExpiredObjectDeleteMarker {
+			values.Set("delete-marker", "true")
+		}
+		if rule.NoncurrentDays > 0 {
+			values.Set("noncurrent-days", strconv.Itoa(rule.NoncurrentDays))
+		}
+		if rule.AbortMultipartDays > 0 {
+			values.Set("abort-days", strconv.Itoa(rule.AbortMultipartDays))
+		}
+		encoded.Add("rule", values.Encode())
+	}
+	return encoded.Encode()
+}
+
+func decodeLifecycle(lifecycle string) ([]LifecycleRule, error) {
+	encoded, err := url.ParseQuery(lifecycle)
+	if err != nil {
+		return nil, fmt.Errorf("malformed lifecycle rules: %w", err)
+	}
+
+	var rules []LifecycleRule
+	for _, encodedRule := range encoded["rule"] {
+		values, err := url.ParseQuery(encodedRule)
+		if err != nil {
+			return nil, fmt.Errorf("malformed lifecycle rule: %w", err)
+		}
+		rule := LifecycleRule{
+			ID:                        values.Get("id"),
+			Prefix:                    values.Get("prefix"),
+			Enabled:                   values.Get("enabled") == "true",
+			ExpiredObjectDeleteMarker: values.Get("delete-marker") == "true",
+		}
+		rule.ExpirationDays, _ = strconv.Atoi(values.Get("days"))
+		rule.NoncurrentDays, _ = strconv.Atoi(values.Get("noncurrent-days"))
+		rule.AbortMultipartDays, _ = strconv.Atoi(values.Get("abort-days"))
+		if date := values.Get("date"); date != "" {
+			rule.ExpirationDate, err = time.Parse(time.RFC3339, date)
+			if err != nil {
+				return nil, fmt.Errorf("malformed lifecycle rule: %w", err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps buckets and objects in memory, everything is lost when the server stops.
+// It supports neither versioning nor multipart uploads: every object only has the null version
+type MemoryStorage struct {
+	mu      sync.RWMutex
+	buckets map[string]*memoryBucket
+	// maxObjectSize limits the size of uploaded objects when set
+	maxObjectSize int64
+}
+
+type memoryBucket struct {
+	info    BucketInfo
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	info ObjectInfo
+	data []byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{buckets: make(map[string]*memoryBucket)}
+}
+
+// SetMaxObjectSize limits the size of every object uploaded from now on, 0 lifts the limit
+func (s *MemoryStorage) SetMaxObjectSize(size int64) {
+	s.maxObjectSize = size
+}
+
+func (s *MemoryStorage) CreateBucket(bucketName string) error {
+	if err := ValidateBucketName(bucketName); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.buckets[bucketName]; found {
+		return ErrBucketAlreadyExists
+	}
+	timeNow := time.Now()
+	s.buckets[bucketName] = &memoryBucket{
+		info:    BucketInfo{Name: bucketName, CreationTime: timeNow, LastModified: timeNow, IsEmpty: true},
+		objects: make(map[string]memoryObject),
+	}
+	return nil
+}
+
+func (s *MemoryStorage) ListBuckets() ([]BucketInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var buckets []BucketInfo
+	for _, bucket := range s.buckets {
+		buckets = append(buckets, bucket.info)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].CreationTime.Before(buckets[j].CreationTime)
+	})
+	return buckets, nil
+}
+
+func (s *MemoryStorage) StatBucket(bucketName string) (BucketInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bucket, found := s.buckets[bucketName]
+	if !found {
+		return BucketInfo{}, ErrNoSuchBucket
+	}
+	return bucket.info, nil
+}
+
+func (s *MemoryStorage) DeleteBucket(bucketName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, found := s.buckets[bucketName]
+	if !found {
+		return ErrNoSuchBucket
+	} else if len(bucket.objects) > 0 {
+		return ErrBucketNotEmpty
+	}
+	delete(s.buckets, bucketName)
+	return nil
+}
+
+func (s *MemoryStorage) PutObject(bucketName, objectKey string, body io.Reader, opts PutOptions) (ObjectInfo, error) {
+	if err := ValidateObjectKey(objectKey); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// the body is read before taking the lock so that slow uploads do not block other requests
+	if s.maxObjectSize > 0 {
+		body = &limitedReader{r: body, remaining: s.maxObjectSize, err: ErrEntityTooLarge}
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	md5Sum := md5.Sum(data)
+	if opts.ContentMD5 != "" && opts.ContentMD5 != base64.StdEncoding.EncodeToString(md5Sum[:]) {
+		return ObjectInfo{}, ErrBadDigest
+	}
+
+	info := ObjectInfo{
+		Key:          objectKey,
+		Size:         int64(len(data)),
+		StoredSize:   int64(len(data)),
+		ContentType:  opts.ContentType,
+		LastModified: time.Now(),
+		ETag:         hex.EncodeToString(md5Sum[:]),
+		IsLatest:     true,
+		Metadata:     opts.Metadata,
+	}
+	if info.ContentType == "" {
+		info.ContentType = http.DetectContentType(data)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, found := s.buckets[bucketName]
+	if !found {
+		return ObjectInfo{}, ErrNoSuchBucket
+	}
+	bucket.objects[objectKey] = memoryObject{info: info, data: data}
+	bucket.info.LastModified = info.LastModified
+	bucket.info.IsEmpty = false
+	return info, nil
+}
+
+func (s *MemoryStorage) GetObject(bucketName, objectKey, versionID string) (ObjectInfo, io.ReadSeekCloser, error) {
+	object, err := s.findObject(bucketName, objectKey, versionID)
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+	return object.info, nopCloser{bytes.NewReader(object.data)}, nil
+}
+
+func (s *MemoryStorage) StatObject(bucketName, objectKey, versionID string) (ObjectInfo, error) {
+	object, err := s.findObject(bucketName, objectKey, versionID)
+	return object.info, err
+}
+
+func (s *MemoryStorage) DeleteObject(bucketName, objectKey, versionID string) (ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, found := s.buckets[bucketName]
+	if !found {
+		return ObjectInfo{}, ErrNoSuchBucket
+	}
+	_, found = bucket.objects[objectKey]
+	if versionID == "" && !found {
+		return ObjectInfo{}, ErrNoSuchKey
+	}
+	return s.deleteObject(bucket, objectKey, versionID)
+}
+
+func (s *MemoryStorage) DeleteObjects(bucketName string, objects []ObjectVersion) ([]DeleteResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, found := s.buckets[bucketName]
+	if !found {
+		return nil, ErrNoSuchBucket
+	}
+
+	results := make([]DeleteResult, len(objects))
+	for i, object := range objects {
+		if err := ValidateObjectKey(object.Key); err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Deleted, results[i].Err = s.deleteObject(bucket, object.Key, object.VersionID)
+	}
+	return results, nil
+}
+
+func (s *MemoryStorage) ListObjects(bucketName string) ([]ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bucket, found := s.buckets[bucketName]
+	if !found {
+		return nil, ErrNoSuchBucket
+	}
+
+	objects := make([]ObjectInfo, 0, len(bucket.objects))
+	for _, object := range bucket.objects {
+		objects = append(objects, object.info)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+// ListObjectsPage sorts the matching keys of the bucket for every page, the objects of a
+// bucket being kept in a map
+func (s *MemoryStorage) ListObjectsPage(bucketName, prefix, startAfter string, limit int) ([]ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bucket, found := s.buckets[bucketName]
+	if !found {
+		return nil, ErrNoSuchBucket
+	}
+
+	var objects []ObjectInfo
+	for key, object := range bucket.objects {
+		if key > startAfter && strings.HasPrefix(key, prefix) {
+			objects = append(objects, object.info)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	if len(objects) > limit {
+		objects = objects[:limit]
+	}
+	return objects, nil
+}
+
+func (s *MemoryStorage) BucketUsage(bucketName string) (BucketUsage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bucket, found := s.buckets[bucketName]
+	if !found {
+		return BucketUsage{}, ErrNoSuchBucket
+	}
+	usage := BucketUsage{Objects: int64(len(bucket.objects))}
+	for _, object := range bucket.objects {
+		usage.Size += object.info.Size
+	}
+	usage.StoredSize = usage.Size
+	return usage, nil
+}
+
+// findObject returns an object, the only version there is can be asked for as "null"
+func (s *MemoryStorage) findObject(bucketName, objectKey, versionID string) (memoryObject, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bucket, found := s.buckets[bucketName]
+	if !found {
+		return memoryObject{}, ErrNoSuchBucket
+	}
+	object, found := bucket.objects[objectKey]
+	if versionID != "" && (versionID != "null" || !found) {
+		return memoryObject{}, ErrNoSuchVersion
+	} else if !found {
+		return memoryObject{}, ErrNoSuchKey
+	}
+	return object, nil
+}
+
+// deleteObject removes an object from a bucket the caller holds the lock of,
+// deleting a key which does not exist succeeds
+func (s *MemoryStorage) deleteObject(bucket *memoryBucket, objectKey, versionID string) (ObjectInfo, error) {
+	object, found := bucket.objects[objectKey]
+	if versionID != "" && (versionID != "null" || !found) {
+		return ObjectInfo{}, ErrNoSuchVersion
+	}
+
+	delete(bucket.objects, objectKey)
+	bucket.info.LastModified = time.Now()
+	bucket.info.IsEmpty = len(bucket.objects) == 0
+	if !found {
+		return ObjectInfo{Key: objectKey}, nil
+	}
+	return object.info, nil
+}
+
+// nopCloser turns the reader of an object kept in memory into an io.ReadSeekCloser
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,432 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+// the metadata of FileStorage lives in <dir>/.metadata/meta.log, an append-only log
+// replayed into a metaIndex on startup. After the magic header the log is a sequence
+// of frames, each holding one batch of updates which is applied all or nothing:
+//
+//	length uint32 | crc32c uint32 | ops
+//
+// where every op is a byte 'P' (put) or 'D' (delete) followed by the key and, for puts,
+// the number of fields of the record and the fields, all strings being prefixed by
+// their length as uvarints. A frame cut short by a crash fails its checksum and is
+// dropped on replay. Once the log holds mostly overwritten records it is compacted,
+// rewritten next to the old one with only the live records and renamed over it
+const (
+	metadataDir  = ".metadata"
+	metaLogName  = "meta.log"
+	metaLogMagic = "TSMETA1\n"
+	// compaction starts once the log is both larger than this and twice the size of the live records
+	minCompactSize = 4 << 20
+	// a compacted log is written in frames of at most this many records
+	compactFrameOps = 4096
+	// frames larger than this are treated as corrupted instead of being allocated
+	maxFrameSize = 1 << 30
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errMetadataLocked = errors.New("the metadata is in use by another process")
+
+// metaDB is an ordered map of string keys to records persisted in the metadata log.
+// Reads are served by the index, every update is appended and synced before it is applied
+type metaDB struct {
+	mu       sync.RWMutex
+	path     string
+	file     *os.File
+	lockFile *os.File
+	index    *metaIndex
+	// logSize is the size of the log file, liveSize estimates what the live records take in it
+	logSize  int64
+	liveSize int64
+	// err is set once the log can no longer be trusted to keep updates, which then all fail
+	err error
+}
+
+// metaOp is a single update of a batch, a nil record deletes the key
+type metaOp struct {
+	key    string
+	record []string
+}
+
+// openMetaDB opens the log at path, creating it if needed, and replays it into the index.
+// The directory is locked so that a second server or fsck cannot use it at the same time
+func openMetaDB(path string) (*metaDB, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	lockFile, err := os.OpenFile(filepath.Dir(path)+"/lock", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		lockFile.Close()
+		return nil, errMetadataLocked
+	} else if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+
+	db := &metaDB{path: path, lockFile: lockFile, index: newMetaIndex()}
+	err = db.replay()
+	if err != nil {
+		db.close()
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if db.needsCompaction() {
+		err = db.compact()
+		if err != nil {
+			db.close()
+			return nil, fmt.Errorf("failed to compact %s: %w", path, err)
+		}
+	}
+	return db, nil
+}
+
+// replay applies every complete frame of the log to the index and truncates what follows them
+func (db *metaDB) replay() error {
+	file, err := os.OpenFile(db.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	db.file = file
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() == 0 {
+		_, err = file.WriteString(metaLogMagic)
+		if err == nil {
+			err = file.Sync()
+		}
+		if err == nil {
+			err = syncDir(filepath.Dir(db.path))
+		}
+		db.logSize = int64(len(metaLogMagic))
+		return err
+	}
+
+	reader := bufio.NewReaderSize(file, 1<<20)
+	magic := make([]byte, len(metaLogMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != metaLogMagic {
+		return errors.New("not a metadata log")
+	}
+
+	offset := int64(len(metaLogMagic))
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		if length > maxFrameSize {
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			break
+		}
+		ops, err := decodeOps(payload)
+		if err != nil {
+			break
+		}
+		db.applyToIndex(ops)
+		offset += int64(len(header)) + int64(length)
+	}
+
+	// whatever follows the last complete frame is a write interrupted by a crash
+	if offset < stat.Size() {
+		fmt.Printf("Discarded %d bytes of an interrupted metadata write\n", stat.Size()-offset)
+		err = file.Truncate(offset)
+		if err == nil {
+			err = file.Sync()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	db.logSize = offset
+	_, err = file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// get returns a copy of the record stored under key
+func (db *metaDB) get(key string) ([]string, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	record, found := db.index.get(key)
+	return slices.Clone(record), found
+}
+
+// ascend calls fn for every key starting with prefix in ascending order until fn returns false.
+// The records passed to fn must not be modified and fn must not call the store
+func (db *metaDB) ascend(prefix string, fn func(key string, record []string) bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	db.index.ascend(prefix, fn)
+}
+
+// ascendFrom is ascend starting at the first key not less than from
+func (db *metaDB) ascendFrom(prefix, from string, fn func(key string, record []string) bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	db.index.ascendFrom(prefix, from, fn)
+}
+
+// apply durably appends a batch of updates to the log and applies it to the index
+func (db *metaDB) apply(ops []metaOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	// the index keeps its own copies so that callers may reuse their records
+	ops = slices.Clone(ops)
+	for i := range ops {
+		ops[i].record = slices.Clone(ops[i].record)
+	}
+	frame := encodeFrame(ops)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.err != nil {
+		return db.err
+	}
+	_, err := db.file.Write(frame)
+	if err == nil {
+		err = db.file.Sync()
+	}
+	if err != nil {
+		// dropping what may have been written so that the next frame starts at a boundary
+		db.file.Truncate(db.logSize)
+		db.file.Seek(db.logSize, io.SeekStart)
+		return err
+	}
+	db.logSize += int64(len(frame))
+	db.applyToIndex(ops)
+
+	// a failed compaction leaves the longer but valid log in place, unless it failed
+	// after replacing it, which makes the following updates fail
+	if db.needsCompaction() {
+		if err := db.compact(); err != nil {
+			fmt.Printf("Failed to compact the metadata log: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// load applies a batch too large for a single frame, such as an import,
+// and writes it to the log by compacting it
+func (db *metaDB) load(ops []metaOp) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.err != nil {
+		return db.err
+	}
+	db.applyToIndex(ops)
+	return db.compact()
+}
+
+func (db *metaDB) applyToIndex(ops []metaOp) {
+	for _, op := range ops {
+		var old []string
+		var found bool
+		if op.record == nil {
+			old, found = db.index.delete(op.key)
+		} else {
+			old, found = db.index.set(op.key, op.record)
+			db.liveSize += opSize(op)
+		}
+		if found {
+			db.liveSize -= opSize(metaOp{op.key, old})
+		}
+	}
+}
+
+func (db *metaDB) needsCompaction() bool {
+	return db.logSize > minCompactSize && db.logSize > 2*db.liveSize
+}
+
+// compact rewrites the log with only the live records, the new log is synced before it
+// replaces the old one so that a crash leaves one of them complete. The new log is written
+// through the file it is appended to from then on, a failure to make its rename durable
+// leaves the store failing every update. The caller holds mu
+func (db *metaDB) compact() error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(db.path), "."+metaLogName+"-*")
+	if err != nil {
+		return err
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		}
+	}()
+
+	writer := bufio.NewWriterSize(tmpFile, 1<<20)
+	size := int64(len(metaLogMagic))
+	writer.WriteString(metaLogMagic)
+	var ops []metaOp
+	flush := func() {
+		frame := encodeFrame(ops)
+		writer.Write(frame)
+		size += int64(len(frame))
+		ops = ops[:0]
+	}
+	db.index.ascend("", func(key string, record []string) bool {
+		ops = append(ops, metaOp{key, record})
+		if len(ops) == compactFrameOps {
+			flush()
+		}
+		return true
+	})
+	if len(ops) > 0 {
+		flush()
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = tmpFile.Chmod(0o644)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpFile.Name(), db.path)
+	if err != nil {
+		return err
+	}
+	renamed = true
+	db.file.Close()
+	db.file = tmpFile
+	db.logSize = size
+
+	err = syncDir(filepath.Dir(db.path))
+	if err != nil {
+		db.err = fmt.Errorf("the compacted metadata log may be lost on restart: %w", err)
+		return db.err
+	}
+	return nil
+}
+
+// isEmpty reports whether the log holds no updates at all
+func (db *metaDB) isEmpty() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.logSize == int64(len(metaLogMagic))
+}
+
+func (db *metaDB) close() error {
+	var err error
+	if db.file != nil {
+		err = db.file.Close()
+	}
+	db.lockFile.Close()
+	return err
+}
+
+func encodeFrame(ops []metaOp) []byte {
+	frame := make([]byte, 8)
+	for _, op := range ops {
+		if op.record == nil {
+			frame = append(frame, 'D')
+			frame = appendString(frame, op.key)
+			continue
+		}
+		frame = append(frame, 'P')
+		frame = appendString(frame, op.key)
+		frame = binary.AppendUvarint(frame, uint64(len(op.record)))
+		for _, field := range op.record {
+			frame = appendString(frame, field)
+		}
+	}
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(frame)-8))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(frame[8:], crcTable))
+	return frame
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func decodeOps(payload []byte) ([]metaOp, error) {
+	var ops []metaOp
+	for len(payload) > 0 {
+		kind := payload[0]
+		payload = payload[1:]
+
+		key, rest, err := readString(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = rest
+
+		switch kind {
+		case 'D':
+			ops = append(ops, metaOp{key: key})
+		case 'P':
+			count, n := binary.Uvarint(payload)
+			if n <= 0 || count > uint64(len(payload)) {
+				return nil, errors.New("invalid record")
+			}
+			payload = payload[n:]
+			record := make([]string, count)
+			for i := range record {
+				record[i], payload, err = readString(payload)
+				if err != nil {
+					return nil, err
+				}
+			}
+			ops = append(ops, metaOp{key: key, record: record})
+		default:
+			return nil, errors.New("invalid operation")
+		}
+	}
+	return ops, nil
+}
+
+func readString(buf []byte) (string, []byte, error) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || length > uint64(len(buf)-n) {
+		return "", nil, errors.New("invalid string")
+	}
+	return string(buf[n : n+int(length)]), buf[n+int(length):], nil
+}
+
+// opSize is the number of bytes an op takes in a frame, near enough for deciding on compaction
+func opSize(op metaOp) int64 {
+	size := int64(len(op.key) + 2)
+	for _, field := range op.record {
+		size += int64(len(field) + 1)
+	}
+	return size
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetaDBUpdatesAfterCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), metadataDir, metaLogName)
+	db, err := openMetaDB(path)
+	if err != nil {
+		t.Fatalf("openMetaDB: %v", err)
+	}
+
+	// overwriting the same keys grows the log until it is compacted, which shrinks it
+	value := strings.Repeat("x", 1024)
+	for round, compacted := 0, false; !compacted; round++ {
+		if round > 1000 {
+			t.Fatalf("the log of %d bytes was never compacted", db.logSize)
+		}
+		for i := 0; i < 100; i++ {
+			size := db.logSize
+			if err := db.apply([]metaOp{{key: fmt.Sprintf("key-%d", i), record: []string{value, fmt.Sprint(round)}}}); err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			compacted = compacted || db.logSize < size
+		}
+	}
+
+	// updates made after the compaction must be written to the log which replaced the old one
+	if err := db.apply([]metaOp{{key: "after", record: []string{"compaction"}}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := db.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	db, err = openMetaDB(path)
+	if err != nil {
+		t.Fatalf("openMetaDB: %v", err)
+	}
+	defer db.close()
+	if record, found := db.get("after"); !found || record[0] != "compaction" {
+		t.Errorf("get after reopening: got %q, %v", record, found)
+	}
+	if record, found := db.get("key-0"); !found || record[0] != value {
+		t.Errorf("get after reopening: got a record of %d fields, %v", len(record), found)
+	}
+}
@@ -0,0 +1,487 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parts of a multipart upload are staged in <dir>/<bucket>/.multipart/<uploadId>/:
+// upload.csv holds the object key, initiation time, content type, metadata, encryption mode
+// and SSE-C key md5 of the upload, every uploaded part is stored in a file of its own named
+// after its part number and a random suffix, and parts.csv gets a row (part number, size, md5,
+// last modified, encryption, file name) appended per uploaded part. Every part is encrypted
+// with a data key of its own, completing the upload decrypts them and encrypts the object with
+// a new one. Parts are stored uncompressed, the object is compressed as set for the bucket
+// when the upload completes
+const multipartDir = ".multipart"
+
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func (s *FileStorage) CreateMultipartUpload(bucketName, objectKey string, opts PutOptions) (string, error) {
+	if err := ValidateObjectKey(objectKey); err != nil {
+		return "", err
+	}
+	if _, err := objectPath(s.dir, bucketName, objectKey); err != nil {
+		return "", err
+	}
+
+	lock := s.bucketLock(bucketName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := s.findBucket(bucketName); err != nil {
+		return "", err
+	}
+
+	keyMD5 := ""
+	if opts.Encryption != "" {
+		if _, err := s.keyEncryptionKey(opts.Encryption, opts.CustomerKey); err != nil {
+			return "", err
+		}
+	}
+	if opts.Encryption == EncryptionCustomer {
+		keyMD5 = CustomerKeyMD5(opts.CustomerKey)
+	}
+
+	uploadID, err := newUploadID()
+	if err != nil {
+		return "", err
+	}
+
+	uploadPath := s.uploadDir(bucketName, uploadID)
+	err = os.MkdirAll(uploadPath, 0o755)
+	if err != nil {
+		return "", err
+	}
+
+	metadata := url.Values{}
+	for name, value := range opts.Metadata {
+		metadata.Set(name, value)
+	}
+	err = writeCSV(uploadPath+"/upload.csv", [][]string{{objectKey, time.Now().Format(time.RFC850), opts.ContentType, metadata.Encode(), opts.Encryption, keyMD5}})
+	if err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+func (s *FileStorage) UploadPart(bucketName, objectKey, uploadID string, partNumber int, body io.Reader, contentMD5 string, customerKey []byte) (PartInfo, error) {
+	lock := s.bucketLock(bucketName)
+	lock.RLock()
+	uploadRecord, err := s.readUpload(bucketName, objectKey, uploadID)
+	lock.RUnlock()
+	if err != nil {
+		return PartInfo{}, err
+	}
+	mode, err := uploadEncryption(uploadRecord, customerKey)
+	if err != nil {
+		return PartInfo{}, err
+	}
+	key, err := s.newFileKey(mode, customerKey)
+	if err != nil {
+		return PartInfo{}, err
+	}
+
+	// a part cannot be larger than what the object may take, nor is it stored when the bucket is full
+	// unless it replaces a part of the same number
+	uploadPath := s.uploadDir(bucketName, uploadID)
+	_, replaced := replacedPart(uploadPath, partNumber)
+	body, err = s.limitUpload(bucketName, objectKey, replaced, body)
+	if err != nil {
+		return PartInfo{}, err
+	}
+
+	// the part is streamed into the upload directory before the bucket is locked
+	staged, err := stageObjectFile(uploadPath, body, contentMD5, key, "")
+	if err != nil {
+		return PartInfo{}, err
+	}
+	defer os.Remove(staged.path)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// the upload may have been completed or aborted meanwhile
+	if _, err := s.readUpload(bucketName, objectKey, uploadID); err != nil {
+		return PartInfo{}, err
+	}
+
+	// the staged parts take room of the quota, concurrent parts may have taken it meanwhile
+	replacedPath, replaced := replacedPart(uploadPath, partNumber)
+	bucketRecord, err := s.findBucket(bucketName)
+	if err != nil {
+		return PartInfo{}, err
+	}
+	err = s.checkUpload(bucketRecord, objectKey, staged.storedSize, replaced)
+	if err != nil {
+		return PartInfo{}, err
+	}
+
+	// a part uploaded again with the same number replaces the previous one: the last row wins.
+	// Its file is new, so that the previous row keeps naming the previous content until the
+	// new row is written, and the replaced file is only removed after that
+	fileName, err := newPartFileName(partNumber)
+	if err != nil {
+		return PartInfo{}, err
+	}
+	err = commitObjectFile(staged.path, uploadPath+"/"+fileName)
+	if err != nil {
+		return PartInfo{}, err
+	}
+	part := PartInfo{
+		PartNumber:   partNumber,
+		Size:         staged.size,
+		ETag:         staged.eTag,
+		LastModified: time.Now(),
+	}
+	err = appendCSV(uploadPath+"/parts.csv", []string{strconv.Itoa(partNumber), strconv.FormatInt(part.Size, 10), part.ETag, part.LastModified.Format(time.RFC850), key.encode(), fileName})
+	if err != nil {
+		os.Remove(uploadPath + "/" + fileName)
+		return PartInfo{}, err
+	}
+	if replacedPath == "" || os.Remove(replacedPath) != nil {
+		replaced = 0
+	}
+	s.updateUsage(bucketName, BucketUsage{UploadSize: staged.storedSize - replaced})
+	return part, nil
+}
+
+func (s *FileStorage) CompleteMultipartUpload(bucketName, objectKey, uploadID string, completedParts []PartInfo, customerKey []byte) (ObjectInfo, error) {
+	lock := s.bucketLock(bucketName)
+	lock.RLock()
+	uploadRecord, err := s.readUpload(bucketName, objectKey, uploadID)
+	if err != nil {
+		lock.RUnlock()
+		return ObjectInfo{}, err
+	}
+	uploadPath := s.uploadDir(bucketName, uploadID)
+	parts, err := readParts(uploadPath)
+	bucketRecord, _ := s.findBucket(bucketName)
+	uploaded := partFilesSize(uploadPath)
+	lock.RUnlock()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	mode, err := uploadEncryption(uploadRecord, customerKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	key, err := s.newFileKey(mode, customerKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// checking the list of parts against the uploaded ones and combining their md5 sums
+	partsHash := md5.New()
+	size := int64(0)
+	for i, completedPart := range completedParts {
+		if i > 0 && completedPart.PartNumber <= completedParts[i-1].PartNumber {
+			return ObjectInfo{}, ErrInvalidPartOrder
+		}
+
+		part, found := parts[completedPart.PartNumber]
+		if !found || strings.Trim(completedPart.ETag, `"`) != part.ETag {
+			return ObjectInfo{}, ErrInvalidPart
+		}
+		if i < len(completedParts)-1 && part.Size < MinPartSize {
+			return ObjectInfo{}, ErrEntityTooSmall
+		}
+
+		md5Sum, _ := hex.DecodeString(part.ETag)
+		partsHash.Write(md5Sum)
+		size += part.Size
+	}
+
+	// an object which does not fit in the limits is refused before its parts are concatenated,
+	// the room of the parts being freed once it is stored
+	lock.RLock()
+	bucketRecord, err = s.findBucket(bucketName)
+	if err == nil {
+		err = s.checkUpload(bucketRecord, objectKey, size, uploaded)
+	}
+	lock.RUnlock()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// concatenating the parts into a temporary file before the bucket is locked, a part
+	// uploaded again meanwhile removes the file of the previous one or is caught by its file name
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeReader.Close()
+	go func() {
+		for _, completedPart := range completedParts {
+			partFile, err := s.openPart(uploadPath, parts[completedPart.PartNumber], customerKey)
+			if os.IsNotExist(err) {
+				err = ErrInvalidPart
+			}
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(pipeWriter, partFile)
+			partFile.Close()
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+		}
+		pipeWriter.Close()
+	}()
+
+	compression := bucketCompression(bucketRecord)
+	staged, err := stageObjectFile(s.dir+"/"+bucketName, pipeReader, "", key, compression)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(staged.path)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// the upload may have been completed or aborted meanwhile
+	if _, err := s.readUpload(bucketName, objectKey, uploadID); err != nil {
+		return ObjectInfo{}, err
+	}
+	currentParts, err := readParts(uploadPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	for _, completedPart := range completedParts {
+		if currentParts[completedPart.PartNumber].file != parts[completedPart.PartNumber].file {
+			return ObjectInfo{}, ErrInvalidPart
+		}
+	}
+
+	bucketRecord, err = s.findBucket(bucketName)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	uploaded = partFilesSize(uploadPath)
+	err = s.checkUpload(bucketRecord, objectKey, staged.size, uploaded)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	versionID, filePath, err := s.newVersionPath(bucketRecord, objectKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	blob, err := s.placeObjectFile(staged, filePath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer s.releaseBlob(blob)
+	contentType := staged.contentType
+	if uploadRecord[2] != "" {
+		contentType = uploadRecord[2]
+	}
+
+	// the multipart ETag is the md5 of the concatenated md5 sums of the parts followed by their count
+	metadata := ""
+	if len(uploadRecord) > 3 {
+		metadata = uploadRecord[3]
+	}
+	record := []string{objectKey, strconv.FormatInt(staged.size, 10), contentType, time.Now().Format(time.RFC850), hex.EncodeToString(partsHash.Sum(nil)) + "-" + strconv.Itoa(len(completedParts)), versionID, "", metadata, key.encode(), compression, strconv.FormatInt(staged.storedSize, 10), blob}
+	err = s.writeObjectRecord(bucketName, record)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	removeReplacedFile(s.dir+"/"+bucketName, blob, versionID, filePath)
+
+	err = s.removeUpload(bucketName, uploadID)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info := objectInfo(record)
+	info.IsLatest = true
+	return info, nil
+}
+
+func (s *FileStorage) AbortMultipartUpload(bucketName, objectKey, uploadID string) error {
+	lock := s.bucketLock(bucketName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := s.readUpload(bucketName, objectKey, uploadID); err != nil {
+		return err
+	}
+	return s.removeUpload(bucketName, uploadID)
+}
+
+// removeUpload removes the directory of an upload and frees the room its parts took,
+// the caller holds the bucket lock
+func (s *FileStorage) removeUpload(bucketName, uploadID string) error {
+	uploadPath := s.uploadDir(bucketName, uploadID)
+	size := partFilesSize(uploadPath)
+	err := os.RemoveAll(uploadPath)
+	if err != nil {
+		return err
+	}
+	s.updateUsage(bucketName, BucketUsage{UploadSize: -size})
+	return nil
+}
+
+func (s *FileStorage) ListParts(bucketName, objectKey, uploadID string) ([]PartInfo, error) {
+	lock := s.bucketLock(bucketName)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if _, err := s.readUpload(bucketName, objectKey, uploadID); err != nil {
+		return nil, err
+	}
+
+	parts, err := readParts(s.uploadDir(bucketName, uploadID))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]PartInfo, 0, len(parts))
+	for _, part := range parts {
+		list = append(list, part.PartInfo)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].PartNumber < list[j].PartNumber
+	})
+	return list, nil
+}
+
+func (s *FileStorage) uploadDir(bucketName, uploadID string) string {
+	return s.dir + "/" + bucketName + "/" + multipartDir + "/" + uploadID
+}
+
+func newUploadID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// readUpload returns the upload.csv record of an upload, failing if
+// the bucket or the upload for the given object key does not exist
+func (s *FileStorage) readUpload(bucketName, objectKey, uploadID string) ([]string, error) {
+	if _, err := s.findBucket(bucketName); err != nil {
+		return nil, err
+	}
+	if !uploadIDPattern.MatchString(uploadID) {
+		return nil, ErrNoSuchUpload
+	}
+
+	records, err := readCSV(s.uploadDir(bucketName, uploadID) + "/upload.csv")
+	if err != nil {
+		return nil, err
+	} else if len(records) == 0 || len(records[0]) < 3 || records[0][0] != objectKey {
+		return nil, ErrNoSuchUpload
+	}
+	return records[0], nil
+}
+
+// uploadEncryption returns the encryption mode of an upload, checking that the parts
+// of an SSE-C upload are sent with the key the upload was created with
+func uploadEncryption(uploadRecord []string, customerKey []byte) (string, error) {
+	if len(uploadRecord) < 6 {
+		return "", nil
+	}
+	if uploadRecord[4] == EncryptionCustomer {
+		if customerKey == nil {
+			return "", ErrCustomerKeyRequired
+		} else if CustomerKeyMD5(customerKey) != uploadRecord[5] {
+			return "", ErrCustomerKeyMismatch
+		}
+	}
+	return uploadRecord[4], nil
+}
+
+// uploadedPart is a part of an upload together with the name and encryption column of its file
+type uploadedPart struct {
+	PartInfo
+	file       string
+	encryption string
+}
+
+// newPartFileName returns a name for the file of a part which no other upload of the part has
+func newPartFileName(partNumber int) (string, error) {
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(partNumber) + "-" + hex.EncodeToString(suffix), nil
+}
+
+// replacedPart returns the path and size of the file of the part with the given number
+// an upload of it would replace, an empty path if it was not uploaded yet
+func replacedPart(uploadPath string, partNumber int) (string, int64) {
+	parts, err := readParts(uploadPath)
+	part, found := parts[partNumber]
+	if err != nil || !found {
+		return "", 0
+	}
+	info, err := os.Stat(uploadPath + "/" + part.file)
+	if err != nil {
+		return "", 0
+	}
+	return uploadPath + "/" + part.file, info.Size()
+}
+
+// openPart opens the content of an uploaded part, decrypting it if needed
+func (s *FileStorage) openPart(uploadPath string, part uploadedPart, customerKey []byte) (io.ReadCloser, error) {
+	key, err := s.recordKey(part.encryption, customerKey)
+	if err != nil {
+		return nil, err
+	}
+	partFile, err := os.Open(uploadPath + "/" + part.file)
+	if err != nil {
+		return nil, err
+	} else if key == nil {
+		return partFile, nil
+	}
+	content, err := newChunkReader(partFile, key.dataKey, part.Size)
+	if err != nil {
+		partFile.Close()
+		return nil, err
+	}
+	return content, nil
+}
+
+// readParts returns the latest parts.csv record of every uploaded part by its part number
+func readParts(uploadPath string) (map[int]uploadedPart, error) {
+	records, err := readAppendedCSV(uploadPath + "/parts.csv")
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make(map[int]uploadedPart)
+	for _, record := range records {
+		if len(record) < 4 {
+			continue
+		}
+		partNumber, err := strconv.Atoi(record[0])
+		if err != nil {
+			continue
+		}
+		size, _ := strconv.ParseInt(record[1], 10, 64)
+		lastModified, _ := time.Parse(time.RFC850, record[3])
+		part := uploadedPart{PartInfo: PartInfo{PartNumber: partNumber, Size: size, ETag: record[2], LastModified: lastModified}}
+		if len(record) > 4 {
+			part.encryption = record[4]
+		}
+		// the rows written before parts had files of their own name the file after the part number
+		part.file = strconv.Itoa(partNumber)
+		if len(record) > 5 {
+			part.file = record[5]
+		}
+		parts[partNumber] = part
+	}
+	return parts, nil
+}
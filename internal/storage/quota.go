@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the quota of a bucket is kept in the eighth column of its record as the URL query encoded
+// maximum size ("size") and number of object versions ("objects"), counted as BucketUsage
+// counts them, the staged parts of multipart uploads included in the size. An upload is cut off
+// as soon as its body goes over the room left, and checked again once the bucket is locked,
+// as concurrent uploads may have taken the room meanwhile, before its file is put in place.
+// A new null version frees the room of the one it replaces, a completed multipart upload that
+// of its parts, and a quota lowered below the usage only keeps the bucket from growing
+const bucketQuotaColumn = 7
+
+func (s *FileStorage) SetQuota(bucketName string, quota BucketQuota) error {
+	lock := s.bucketLock(bucketName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := s.findBucket(bucketName); err != nil {
+		return err
+	}
+
+	return s.updateBucket(bucketName, func(record []string) []string {
+		for len(record) <= bucketQuotaColumn {
+			record = append(record, "")
+		}
+		record[bucketQuotaColumn] = encodeQuota(quota)
+		return record
+	})
+}
+
+// SetMaxObjectSize limits the size of every object uploaded from now on, 0 lifts the limit
+func (s *FileStorage) SetMaxObjectSize(size int64) {
+	s.maxObjectSize = size
+}
+
+// uploadLimit returns the most bytes an upload of an object can take, -1 for no limit,
+// with the error it is refused with when it takes more, once freed bytes of the staged parts
+// it replaces are removed. The caller holds the bucket lock
+func (s *FileStorage) uploadLimit(bucketRecord []string, objectKey string, freed int64) (limit int64, exceeded error, err error) {
+	limit, exceeded = -1, ErrEntityTooLarge
+	if s.maxObjectSize > 0 {
+		limit = s.maxObjectSize
+	}
+
+	quota := bucketQuota(bucketRecord)
+	if quota.MaxSize <= 0 && quota.MaxObjects <= 0 {
+		return limit, exceeded, nil
+	}
+	usage := s.bucketUsage(bucketRecord[0])
+	usage.Size += usage.UploadSize - freed
+
+	// a new null version replaces the null version of the key, current or not
+	if bucketVersioning(bucketRecord) != VersioningEnabled {
+		objectsRecords, versionRecords := s.readKeyVersions(bucketRecord[0], objectKey)
+		for _, record := range append(objectsRecords, versionRecords...) {
+			if versionID(record) == "" && !isDeleteMarker(record) {
+				size, _ := strconv.ParseInt(record[1], 10, 64)
+				usage.Objects--
+				usage.Size -= size
+			}
+		}
+	}
+
+	if quota.MaxObjects > 0 && usage.Objects >= quota.MaxObjects {
+		return 0, nil, ErrQuotaExceeded
+	}
+	if quota.MaxSize > 0 && (limit < 0 || quota.MaxSize-usage.Size < limit) {
+		limit, exceeded = max(0, quota.MaxSize-usage.Size), ErrQuotaExceeded
+	}
+	return limit, exceeded, nil
+}
+
+// checkUpload fails an upload of size bytes replacing freed bytes of staged parts which
+// does not fit in the limits, the caller holds the bucket lock
+func (s *FileStorage) checkUpload(bucketRecord []string, objectKey string, size, freed int64) error {
+	limit, exceeded, err := s.uploadLimit(bucketRecord, objectKey, freed)
+	if err != nil {
+		return err
+	} else if limit >= 0 && size > limit {
+		return exceeded
+	}
+	return nil
+}
+
+// limitUpload returns body failing with the error of the tightest limit of an upload, replacing
+// freed bytes of staged parts, once it goes over it
+func (s *FileStorage) limitUpload(bucketName, objectKey string, freed int64, body io.Reader) (io.Reader, error) {
+	lock := s.bucketLock(bucketName)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	bucketRecord, err := s.findBucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	limit, exceeded, err := s.uploadLimit(bucketRecord, objectKey, freed)
+	if err != nil || limit < 0 {
+		return body, err
+	}
+	return &limitedReader{r: body, remaining: limit, err: exceeded}, nil
+}
+
+// bucketUsage returns the usage of a bucket, counted from its records and upload directories
+// the first time and kept up to date by commitBucket and the multipart uploads afterwards.
+// The caller holds the bucket lock
+func (s *FileStorage) bucketUsage(bucketName string) BucketUsage {
+	s.usageMu.Lock()
+	usage, found := s.usage[bucketName]
+	s.usageMu.Unlock()
+	if found {
+		return usage
+	}
+
+	for _, prefix := range []string{objectIndexPrefix(bucketName), versionIndexPrefix(bucketName)} {
+		s.meta.ascend(prefix, func(_ string, record []string) bool {
+			usage = addRecordUsage(usage, record, 1)
+			return true
+		})
+	}
+	entries, _ := os.ReadDir(s.dir + "/" + bucketName + "/" + multipartDir)
+	for _, entry := range entries {
+		if entry.IsDir() && uploadIDPattern.MatchString(entry.Name()) {
+			usage.UploadSize += partFilesSize(s.uploadDir(bucketName, entry.Name()))
+		}
+	}
+
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	if s.usage == nil {
+		s.usage = make(map[string]BucketUsage)
+	}
+	s.usage[bucketName] = usage
+	return usage
+}
+
+// usageDelta returns by how much a batch of record updates changes the usage of a bucket,
+// comparing every record to the one it replaces. The caller holds the bucket lock
+func (s *FileStorage) usageDelta(ops []metaOp) BucketUsage {
+	var delta BucketUsage
+	s.eachReplaced(ops, func(old, new []string) {
+		delta = addRecordUsage(delta, old, -1)
+		delta = addRecordUsage(delta, new, 1)
+	})
+	return delta
+}
+
+// updateUsage applies a change to the usage of a bucket if it is counted, the caller holds the bucket lock
+func (s *FileStorage) updateUsage(bucketName string, delta BucketUsage) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+
+	usage, found := s.usage[bucketName]
+	if !found {
+		return
+	}
+	usage.Objects += delta.Objects
+	usage.Size += delta.Size
+	usage.StoredSize += delta.StoredSize
+	usage.UploadSize += delta.UploadSize
+	s.usage[bucketName] = usage
+}
+
+// addRecordUsage adds what an object or version record takes to usage sign times, delete markers take nothing
+func addRecordUsage(usage BucketUsage, record []string, sign int64) BucketUsage {
+	if len(record) < 2 || isDeleteMarker(record) {
+		return usage
+	}
+	size, _ := strconv.ParseInt(record[1], 10, 64)
+	usage.Objects += sign
+	usage.Size += sign * size
+	usage.StoredSize += sign * recordStoredSize(record)
+	return usage
+}
+
+// partFilesSize returns the size of the part files staged in an upload directory
+func partFilesSize(uploadPath string) int64 {
+	entries, _ := os.ReadDir(uploadPath)
+	size := int64(0)
+	for _, entry := range entries {
+		partNumber, _, _ := strings.Cut(entry.Name(), "-")
+		if _, err := strconv.Atoi(partNumber); err != nil {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func bucketQuota(record []string) BucketQuota {
+	var quota BucketQuota
+	if len(record) <= bucketQuotaColumn {
+		return quota
+	}
+	values, err := url.ParseQuery(record[bucketQuotaColumn])
+	if err != nil {
+		return quota
+	}
+	quota.MaxSize, _ = strconv.ParseInt(values.Get("size"), 10, 64)
+	quota.MaxObjects, _ = strconv.ParseInt(values.Get("objects"), 10, 64)
+	return quota
+}
+
+func encodeQuota(quota BucketQuota) string {
+	values := url.Values{}
+	if quota.MaxSize > 0 {
+		values.Set("size", strconv.FormatInt(quota.MaxSize, 10))
+	}
+	if quota.MaxObjects > 0 {
+		values.Set("objects", strconv.FormatInt(quota.MaxObjects, 10))
+	}
+	return values.Encode()
+}
+
+// limitedReader fails with err once more than remaining bytes are read, where io.LimitReader
+// would end the body early and let a truncated upload be stored
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, l.err
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, l.err
+	}
+	return n, err
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// restoreBuckets reconciles the bucket records with the bucket directories found in dir
+// on startup: existing metadata is kept, buckets whose directory exists but has no record
+// are added back, and the emptiness of every bucket is recalculated from its object records
+// and the noncurrent versions it keeps as well as from the files in its directory, so that
+// a bucket whose metadata was lost is never deleted with its files
+func restoreBuckets(dir string, meta *metaDB) error {
+	var records [][]string
+	meta.ascend(bucketIndexKey(""), func(_ string, record []string) bool {
+		records = append(records, slices.Clone(record))
+		return true
+	})
+	known := make(map[string]bool)
+	for _, record := range records {
+		known[record[0]] = true
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read the directory: %w", err)
+	}
+
+	// directories which were left without metadata are treated as buckets again
+	var ops []metaOp
+	for _, entry := range entries {
+		if !entry.IsDir() || known[entry.Name()] || ValidateBucketName(entry.Name()) != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", entry.Name(), err)
+		}
+		modTime := info.ModTime().Format(time.RFC850)
+		known[entry.Name()] = true
+		records = append(records, []string{entry.Name(), modTime, modTime, ""})
+		fmt.Println("Restored metadata of the bucket: " + entry.Name())
+	}
+
+	for _, record := range records {
+		// buckets with metadata but without a directory get their directory back
+		err := os.MkdirAll(dir+"/"+record[0], 0o755)
+		if err != nil {
+			return fmt.Errorf("failed to create the bucket directory %s: %w", record[0], err)
+		}
+
+		// padding records written by older versions up to the 4 known columns
+		restored := slices.Clone(record)
+		for len(restored) < 4 {
+			restored = append(restored, "")
+		}
+		if restored[1] == "" {
+			restored[1] = time.Now().Format(time.RFC850)
+		}
+		if restored[2] == "" {
+			restored[2] = restored[1]
+		}
+		hasFiles, err := hasObjectFiles(dir + "/" + restored[0])
+		if err != nil {
+			return fmt.Errorf("failed to read the bucket directory %s: %w", restored[0], err)
+		}
+		if bucketIsEmpty(meta, restored[0], nil) && !hasFiles {
+			restored[3] = "True"
+		} else {
+			restored[3] = "False"
+		}
+
+		if !slices.Equal(record, restored) {
+			ops = append(ops, metaOp{bucketIndexKey(restored[0]), restored})
+		}
+	}
+
+	err = meta.apply(ops)
+	if err != nil {
+		return fmt.Errorf("failed to write the bucket metadata: %w", err)
+	}
+	return nil
+}
+
+// hasObjectFiles reports whether a bucket directory holds files of object versions,
+// leaving out the multipart uploads, the imported csv files and temporary files
+func hasObjectFiles(bucketDir string) (bool, error) {
+	found := false
+	err := filepath.WalkDir(bucketDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if filePath == bucketDir && os.IsNotExist(err) {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		relativePath := strings.TrimPrefix(filePath, bucketDir+"/")
+		if entry.IsDir() {
+			if relativePath == multipartDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if importedFiles[relativePath] || isTemporaryFile(entry.Name()) {
+			return nil
+		}
+		found = true
+		return filepath.SkipAll
+	})
+	return found, err
+}
+
+// layoutIndexKey holds the version of the layout of the object files, missing in the
+// metadata of data directories whose object files are not suffixed yet
+const (
+	layoutIndexKey = "l\x00"
+	objectLayout   = "2"
+)
+
+// migrateObjectFiles renames the object files of data directories written by older versions,
+// named after their key path without objectFileSuffix, once for all. Files already renamed
+// are skipped, so an interrupted migration is simply run again on the next start
+func migrateObjectFiles(dir string, meta *metaDB) (int, error) {
+	if record, found := meta.get(layoutIndexKey); found && len(record) > 0 && record[0] == objectLayout {
+		return 0, nil
+	}
+
+	var bucketNames []string
+	meta.ascend(bucketIndexKey(""), func(_ string, record []string) bool {
+		bucketNames = append(bucketNames, record[0])
+		return true
+	})
+
+	migrated := 0
+	for _, bucketName := range bucketNames {
+		bucketDir := dir + "/" + bucketName
+		var filePaths []string
+		err := filepath.WalkDir(bucketDir, func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if filePath == bucketDir && os.IsNotExist(err) {
+					return filepath.SkipAll
+				}
+				return err
+			}
+			// the versions, uploads, imported csv files and temporary files all start with a dot
+			name := entry.Name()
+			if filePath == bucketDir {
+				return nil
+			} else if strings.HasPrefix(name, ".") {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if entry.Type().IsRegular() && !strings.HasSuffix(name, objectFileSuffix) && !importedFiles[strings.TrimPrefix(filePath, bucketDir+"/")] {
+				filePaths = append(filePaths, filePath)
+			}
+			return nil
+		})
+		if err != nil {
+			return migrated, fmt.Errorf("failed to read the bucket directory %s: %w", bucketName, err)
+		}
+
+		dirs := make(map[string]bool)
+		for _, filePath := range filePaths {
+			err = os.Rename(filePath, filePath+objectFileSuffix)
+			if err != nil {
+				return migrated, err
+			}
+			dirs[filepath.Dir(filePath)] = true
+			migrated++
+		}
+		for fileDir := range dirs {
+			if err = syncDir(fileDir); err != nil {
+				return migrated, err
+			}
+		}
+	}
+
+	err := meta.apply([]metaOp{{layoutIndexKey, []string{objectLayout}}})
+	return migrated, err
+}
@@ -0,0 +1,254 @@
+// Package storage keeps the buckets and objects of triple-s behind the Storage interface
+// so that the HTTP handlers do not depend on where and how they are stored
+package storage
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// Storage is implemented by every storage backend. Version ids passed to the object
+// methods are the ones reported to clients: empty for the current version of an object
+// and "null" for the version stored while versioning was never enabled or suspended
+type Storage interface {
+	CreateBucket(bucketName string) error
+	ListBuckets() ([]BucketInfo, error)
+	StatBucket(bucketName string) (BucketInfo, error)
+	DeleteBucket(bucketName string) error
+
+	// PutObject stores body as the new current version of an object
+	PutObject(bucketName, objectKey string, body io.Reader, opts PutOptions) (ObjectInfo, error)
+	// GetObject returns an object version together with its content, which the caller must close
+	GetObject(bucketName, objectKey, versionID string) (ObjectInfo, io.ReadSeekCloser, error)
+	StatObject(bucketName, objectKey, versionID string) (ObjectInfo, error)
+	// DeleteObject deletes an object, or permanently one of its versions, and returns
+	// what was deleted: with versioning enabled or suspended that is a new delete marker
+	DeleteObject(bucketName, objectKey, versionID string) (ObjectInfo, error)
+	// DeleteObjects deletes several objects of a bucket at once, every result
+	// holds the deleted object or the error of the object at the same index
+	DeleteObjects(bucketName string, objects []ObjectVersion) ([]DeleteResult, error)
+	// ListObjects returns the current versions of all objects of a bucket sorted by key
+	ListObjects(bucketName string) ([]ObjectInfo, error)
+	// ListObjectsPage returns, sorted by key, at most limit current versions of the objects
+	// of a bucket whose key starts with prefix and sorts after startAfter
+	ListObjectsPage(bucketName, prefix, startAfter string, limit int) ([]ObjectInfo, error)
+}
+
+// VersioningStorage is implemented by backends supporting object versioning
+type VersioningStorage interface {
+	SetVersioning(bucketName, status string) error
+	// ListObjectVersions returns every version and delete marker of the objects of
+	// a bucket sorted by key, the versions of a key ordered from the newest one
+	ListObjectVersions(bucketName string) ([]ObjectInfo, error)
+	// ListObjectVersionsPage returns at most limit entries of ListObjectVersions whose key starts
+	// with prefix, from after the version of keyMarker reported as versionIDMarker, or after
+	// every version of keyMarker when versionIDMarker is empty
+	ListObjectVersionsPage(bucketName, prefix, keyMarker, versionIDMarker string, limit int) ([]ObjectInfo, error)
+}
+
+// MultipartStorage is implemented by backends supporting multipart uploads
+type MultipartStorage interface {
+	CreateMultipartUpload(bucketName, objectKey string, opts PutOptions) (string, error)
+	// UploadPart stores a part of an upload, customerKey is the SSE-C key of uploads created with one
+	UploadPart(bucketName, objectKey, uploadID string, partNumber int, body io.Reader, contentMD5 string, customerKey []byte) (PartInfo, error)
+	// CompleteMultipartUpload assembles the listed parts, given in ascending order, into the object
+	CompleteMultipartUpload(bucketName, objectKey, uploadID string, parts []PartInfo, customerKey []byte) (ObjectInfo, error)
+	AbortMultipartUpload(bucketName, objectKey, uploadID string) error
+	// ListParts returns the uploaded parts sorted by their part number
+	ListParts(bucketName, objectKey, uploadID string) ([]PartInfo, error)
+}
+
+// EncryptionStorage is implemented by backends supporting server-side encryption, which
+// store objects encrypted as requested by PutOptions.Encryption. GetObject decrypts SSE-S3
+// objects transparently while SSE-C objects are only read with the key they were stored with
+type EncryptionStorage interface {
+	GetEncryptedObject(bucketName, objectKey, versionID string, customerKey []byte) (ObjectInfo, io.ReadSeekCloser, error)
+}
+
+// CompressionStorage is implemented by backends able to store the objects of a bucket
+// compressed, which is transparent to clients reading them
+type CompressionStorage interface {
+	// SetCompression sets the algorithm the objects written to a bucket from now on are
+	// compressed with, CompressionGzip or CompressionFlate, or disables compression when empty
+	SetCompression(bucketName, algorithm string) error
+}
+
+// UsageStorage is implemented by backends reporting the space the buckets take
+type UsageStorage interface {
+	BucketUsage(bucketName string) (BucketUsage, error)
+}
+
+// LifecycleStorage is implemented by backends able to expire objects by the lifecycle rules of their buckets
+type LifecycleStorage interface {
+	// SetLifecycle replaces the lifecycle rules of a bucket, no rules remove them
+	SetLifecycle(bucketName string, rules []LifecycleRule) error
+	// Lifecycle returns the lifecycle rules of a bucket, none if it has no lifecycle configuration
+	Lifecycle(bucketName string) ([]LifecycleRule, error)
+	// ApplyLifecycle deletes what the rules of every bucket expire at the given time and
+	// returns the number of object versions, delete markers and multipart uploads deleted
+	ApplyLifecycle(now time.Time) (int, error)
+}
+
+// QuotaStorage is implemented by backends able to limit what the buckets hold
+type QuotaStorage interface {
+	// SetQuota replaces the quota of a bucket, a zero quota lifts it
+	SetQuota(bucketName string, quota BucketQuota) error
+}
+
+type BucketInfo struct {
+	Name         string
+	CreationTime time.Time
+	LastModified time.Time
+	IsEmpty      bool
+	Versioning   string
+	Compression  string
+	Quota        BucketQuota
+}
+
+// BucketQuota limits the size and the number of the object versions a bucket holds as
+// BucketUsage counts them, the parts of multipart uploads in progress taking room of
+// MaxSize as well. A limit set to zero is not enforced
+type BucketQuota struct {
+	MaxSize    int64
+	MaxObjects int64
+}
+
+// BucketUsage counts every stored object version of a bucket, delete markers aside
+type BucketUsage struct {
+	Objects int64
+	// Size is the size of the contents and StoredSize that of the files holding them,
+	// which differ for compressed and encrypted objects
+	Size       int64
+	StoredSize int64
+	// UploadSize is the size of the part files of the multipart uploads in progress
+	UploadSize int64
+}
+
+type ObjectInfo struct {
+	Key  string
+	Size int64
+	// StoredSize is the size the content takes in the storage
+	StoredSize   int64
+	ContentType  string
+	LastModified time.Time
+	// ETag is the unquoted md5 of the content, or the md5 of the md5 sums of the parts
+	// followed by their count for multipart uploads, objects stored before ETags have none
+	ETag string
+	// VersionID is empty for the null version
+	VersionID    string
+	IsLatest     bool
+	DeleteMarker bool
+	// Metadata holds the standard and the x-amz-meta-* headers stored with the object by their lower case names
+	Metadata map[string]string
+	// Encryption is the server-side encryption of the object, empty when stored in plaintext
+	Encryption string
+	// CustomerKeyMD5 is the base64 md5 of the key SSE-C objects were encrypted with
+	CustomerKeyMD5 string
+}
+
+type PutOptions struct {
+	// ContentType is sniffed from the first 512 bytes of the content when empty
+	ContentType string
+	// ContentMD5 is the base64 encoded md5 the content is checked against when set
+	ContentMD5 string
+	Metadata   map[string]string
+	// Encryption is EncryptionS3 or EncryptionCustomer to store the content encrypted
+	Encryption string
+	// CustomerKey is the 256-bit key SSE-C encrypts with
+	CustomerKey []byte
+}
+
+// LifecycleRule expires the objects whose key starts with Prefix, an action set to zero is not taken
+type LifecycleRule struct {
+	ID      string
+	Prefix  string
+	Enabled bool
+	// ExpirationDays deletes current versions that many days after they were written,
+	// and every current version once the ExpirationDate is reached
+	ExpirationDays int
+	ExpirationDate time.Time
+	// ExpiredObjectDeleteMarker deletes delete markers with no versions left behind them
+	ExpiredObjectDeleteMarker bool
+	// NoncurrentDays deletes versions that many days after they became noncurrent
+	NoncurrentDays int
+	// AbortMultipartDays aborts multipart uploads that many days after they were created
+	AbortMultipartDays int
+}
+
+type PartInfo struct {
+	PartNumber   int
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+type ObjectVersion struct {
+	Key       string
+	VersionID string
+}
+
+type DeleteResult struct {
+	Deleted ObjectInfo
+	Err     error
+}
+
+const (
+	VersioningEnabled   = "Enabled"
+	VersioningSuspended = "Suspended"
+)
+
+const (
+	EncryptionS3       = "SSE-S3"
+	EncryptionCustomer = "SSE-C"
+)
+
+const (
+	CompressionGzip  = "gzip"
+	CompressionFlate = "flate"
+)
+
+const (
+	MaxPartNumber = 10000
+	MinPartSize   = 5 << 20
+)
+
+var (
+	ErrNoSuchBucket        = errors.New("The specified bucket does not exist")
+	ErrBucketAlreadyExists = errors.New("The requested bucket name is not available")
+	ErrBucketNotEmpty      = errors.New("The bucket you tried to delete is not empty")
+	ErrNoSuchKey           = errors.New("The specified key does not exist")
+	ErrNoSuchVersion       = errors.New("The specified version does not exist")
+	ErrDeleteMarker        = errors.New("The specified version is a delete marker")
+	ErrKeyTooLong          = errors.New("Your key is too long")
+	ErrBadDigest           = errors.New("The Content-MD5 you specified did not match what was received")
+	ErrNoSuchUpload        = errors.New("The specified multipart upload does not exist")
+	ErrInvalidPart         = errors.New("One or more of the specified parts could not be found")
+	ErrInvalidPartOrder    = errors.New("The list of parts was not in ascending order")
+	ErrEntityTooSmall      = errors.New("Your proposed upload is smaller than the minimum allowed object size")
+	ErrEntityTooLarge      = errors.New("Your proposed upload exceeds the maximum allowed object size")
+	ErrQuotaExceeded       = errors.New("The bucket quota does not leave room for the upload")
+	// ErrCustomerKeyRequired is returned when reading an SSE-C object without its key
+	ErrCustomerKeyRequired = errors.New("The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object")
+	ErrCustomerKeyMismatch = errors.New("The provided customer key does not match the key the object was encrypted with")
+	// ErrEncryptionNotConfigured is returned for SSE-S3 when the backend has no master key
+	ErrEncryptionNotConfigured = errors.New("Server side encryption is not configured")
+)
+
+// InvalidBucketNameError is returned for a bucket name breaking the naming rules
+type InvalidBucketNameError struct {
+	Reason string
+}
+
+func (e *InvalidBucketNameError) Error() string {
+	return e.Reason
+}
+
+// InvalidKeyError is returned for an object key breaking the key rules
+type InvalidKeyError struct {
+	Reason string
+}
+
+func (e *InvalidKeyError) Error() string {
+	return e.Reason
+}
@@ -0,0 +1,363 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// errInvalid stands for the InvalidBucketNameError and InvalidKeyError of rejected names and keys
+var errInvalid = errors.New("invalid name or key")
+
+// contractObjects are stored in the bucket "contract" before every case
+var contractObjects = []string{"a", "a/b", "b", "c/"}
+
+// contractCases describe the behavior every Storage shares, each case runs on a storage holding
+// the bucket "contract" with contractObjects, whose content is "data-" followed by the key,
+// and the empty bucket "empty"
+var contractCases = []struct {
+	name    string
+	run     func(store Storage) (string, error)
+	want    string
+	wantErr error
+}{
+	{
+		name:    "create existing bucket",
+		run:     func(store Storage) (string, error) { return "", store.CreateBucket("contract") },
+		wantErr: ErrBucketAlreadyExists,
+	},
+	{
+		name:    "create bucket with invalid name",
+		run:     func(store Storage) (string, error) { return "", store.CreateBucket("Invalid_Name") },
+		wantErr: errInvalid,
+	},
+	{
+		name: "list buckets",
+		run: func(store Storage) (string, error) {
+			buckets, err := store.ListBuckets()
+			var names []string
+			for _, bucket := range buckets {
+				names = append(names, bucket.Name)
+			}
+			slices.Sort(names)
+			return strings.Join(names, " "), err
+		},
+		want: "contract empty",
+	},
+	{
+		name: "stat buckets",
+		run: func(store Storage) (string, error) {
+			filled, err := store.StatBucket("contract")
+			if err != nil {
+				return "", err
+			}
+			empty, err := store.StatBucket("empty")
+			return fmt.Sprintf("%v %v", filled.IsEmpty, empty.IsEmpty), err
+		},
+		want: "false true",
+	},
+	{
+		name:    "stat missing bucket",
+		run:     func(store Storage) (string, error) { _, err := store.StatBucket("missing"); return "", err },
+		wantErr: ErrNoSuchBucket,
+	},
+	{
+		name:    "delete bucket with objects",
+		run:     func(store Storage) (string, error) { return "", store.DeleteBucket("contract") },
+		wantErr: ErrBucketNotEmpty,
+	},
+	{
+		name:    "delete missing bucket",
+		run:     func(store Storage) (string, error) { return "", store.DeleteBucket("missing") },
+		wantErr: ErrNoSuchBucket,
+	},
+	{
+		name: "delete empty bucket",
+		run: func(store Storage) (string, error) {
+			if err := store.DeleteBucket("empty"); err != nil {
+				return "", err
+			}
+			_, err := store.StatBucket("empty")
+			return "", err
+		},
+		wantErr: ErrNoSuchBucket,
+	},
+	{
+		name: "delete bucket once emptied",
+		run: func(store Storage) (string, error) {
+			for _, key := range contractObjects {
+				if _, err := store.DeleteObject("contract", key, ""); err != nil {
+					return "", err
+				}
+			}
+			bucket, err := store.StatBucket("contract")
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprint(bucket.IsEmpty), store.DeleteBucket("contract")
+		},
+		want: "true",
+	},
+	{
+		name: "get objects sharing a prefix",
+		run: func(store Storage) (string, error) {
+			var contents []string
+			for _, key := range contractObjects {
+				data, err := readObject(store, "contract", key)
+				if err != nil {
+					return "", err
+				}
+				contents = append(contents, data)
+			}
+			return strings.Join(contents, " "), nil
+		},
+		want: "data-a data-a/b data-b data-c/",
+	},
+	{
+		name:    "get missing object",
+		run:     func(store Storage) (string, error) { return readObject(store, "contract", "a/") },
+		wantErr: ErrNoSuchKey,
+	},
+	{
+		name: "get object of missing bucket",
+		run: func(store Storage) (string, error) {
+			_, _, err := store.GetObject("missing", "a", "")
+			return "", err
+		},
+		wantErr: ErrNoSuchBucket,
+	},
+	{
+		name: "stat object",
+		run: func(store Storage) (string, error) {
+			object, err := store.StatObject("contract", "a/b", "")
+			return fmt.Sprintf("%s %d %s %s", object.Key, object.Size, object.ETag, object.ContentType), err
+		},
+		want: "a/b 8 " + md5Hex("data-a/b") + " text/plain; charset=utf-8",
+	},
+	{
+		name: "stat missing object",
+		run: func(store Storage) (string, error) {
+			_, err := store.StatObject("contract", "missing", "")
+			return "", err
+		},
+		wantErr: ErrNoSuchKey,
+	},
+	{
+		name: "overwrite object",
+		run: func(store Storage) (string, error) {
+			_, err := store.PutObject("contract", "a", strings.NewReader("new"), PutOptions{
+				ContentType: "application/x-test",
+				Metadata:    map[string]string{"color": "blue"},
+			})
+			if err != nil {
+				return "", err
+			}
+			object, err := store.StatObject("contract", "a", "")
+			if err != nil {
+				return "", err
+			}
+			data, err := readObject(store, "contract", "a")
+			return fmt.Sprintf("%s %s %s", data, object.ContentType, object.Metadata["color"]), err
+		},
+		want: "new application/x-test blue",
+	},
+	{
+		name: "put object with matching Content-MD5",
+		run: func(store Storage) (string, error) {
+			_, err := store.PutObject("contract", "d", strings.NewReader("data-d"), PutOptions{ContentMD5: md5Base64("data-d")})
+			if err != nil {
+				return "", err
+			}
+			return readObject(store, "contract", "d")
+		},
+		want: "data-d",
+	},
+	{
+		name: "put object with wrong Content-MD5",
+		run: func(store Storage) (string, error) {
+			_, err := store.PutObject("contract", "a", strings.NewReader("new"), PutOptions{ContentMD5: md5Base64("other")})
+			if !errors.Is(err, ErrBadDigest) {
+				return "", err
+			}
+			return readObject(store, "contract", "a")
+		},
+		want: "data-a",
+	},
+	{
+		name: "put object with invalid key",
+		run: func(store Storage) (string, error) {
+			_, err := store.PutObject("contract", "", strings.NewReader("data"), PutOptions{})
+			return "", err
+		},
+		wantErr: errInvalid,
+	},
+	{
+		name: "put object into missing bucket",
+		run: func(store Storage) (string, error) {
+			_, err := store.PutObject("missing", "a", strings.NewReader("data"), PutOptions{})
+			return "", err
+		},
+		wantErr: ErrNoSuchBucket,
+	},
+	{
+		name: "delete object keeps the keys under it",
+		run: func(store Storage) (string, error) {
+			if _, err := store.DeleteObject("contract", "a", ""); err != nil {
+				return "", err
+			}
+			if _, err := readObject(store, "contract", "a"); !errors.Is(err, ErrNoSuchKey) {
+				return "", fmt.Errorf("get deleted object: %v", err)
+			}
+			return listKeys(store.ListObjects("contract"))
+		},
+		want: "a/b b c/",
+	},
+	{
+		name: "delete missing object",
+		run: func(store Storage) (string, error) {
+			_, err := store.DeleteObject("contract", "missing", "")
+			return "", err
+		},
+		wantErr: ErrNoSuchKey,
+	},
+	{
+		name: "delete several objects",
+		run: func(store Storage) (string, error) {
+			results, err := store.DeleteObjects("contract", []ObjectVersion{{Key: "a/b"}, {Key: "missing"}, {Key: ""}})
+			if err != nil {
+				return "", err
+			}
+			var outcomes []string
+			for _, result := range results {
+				outcomes = append(outcomes, fmt.Sprintf("%s:%v", result.Deleted.Key, result.Err != nil))
+			}
+			keys, err := listKeys(store.ListObjects("contract"))
+			return strings.Join(outcomes, " ") + " | " + keys, err
+		},
+		want: "a/b:false missing:false :true | a b c/",
+	},
+	{
+		name: "delete objects of missing bucket",
+		run: func(store Storage) (string, error) {
+			_, err := store.DeleteObjects("missing", []ObjectVersion{{Key: "a"}})
+			return "", err
+		},
+		wantErr: ErrNoSuchBucket,
+	},
+	{
+		name: "list objects",
+		run:  func(store Storage) (string, error) { return listKeys(store.ListObjects("contract")) },
+		want: "a a/b b c/",
+	},
+	{
+		name: "list objects of missing bucket",
+		run: func(store Storage) (string, error) {
+			_, err := store.ListObjects("missing")
+			return "", err
+		},
+		wantErr: ErrNoSuchBucket,
+	},
+	{
+		name: "list objects of empty bucket",
+		run:  func(store Storage) (string, error) { return listKeys(store.ListObjects("empty")) },
+		want: "",
+	},
+	{
+		name: "list page by prefix",
+		run:  func(store Storage) (string, error) { return listKeys(store.ListObjectsPage("contract", "a", "", 10)) },
+		want: "a a/b",
+	},
+	{
+		name: "list page after a key",
+		run:  func(store Storage) (string, error) { return listKeys(store.ListObjectsPage("contract", "", "a", 10)) },
+		want: "a/b b c/",
+	},
+	{
+		name: "list page after a key not stored",
+		run:  func(store Storage) (string, error) { return listKeys(store.ListObjectsPage("contract", "", "a/a", 10)) },
+		want: "a/b b c/",
+	},
+	{
+		name: "list page up to the limit",
+		run:  func(store Storage) (string, error) { return listKeys(store.ListObjectsPage("contract", "", "", 2)) },
+		want: "a a/b",
+	},
+	{
+		name: "list page by prefix after its last key",
+		run:  func(store Storage) (string, error) { return listKeys(store.ListObjectsPage("contract", "c", "c/", 10)) },
+		want: "",
+	},
+	{
+		name: "list page of missing bucket",
+		run: func(store Storage) (string, error) {
+			_, err := store.ListObjectsPage("missing", "", "", 10)
+			return "", err
+		},
+		wantErr: ErrNoSuchBucket,
+	},
+}
+
+func TestStorageContract(t *testing.T) {
+	for _, tc := range contractCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for name, store := range testStorages(t) {
+				t.Run(name, func(t *testing.T) {
+					fillContract(t, store)
+					got, err := tc.run(store)
+					if !matchErr(err, tc.wantErr) {
+						t.Fatalf("got error %v, want %v", err, tc.wantErr)
+					}
+					if tc.wantErr == nil && got != tc.want {
+						t.Errorf("got %q, want %q", got, tc.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func fillContract(t *testing.T, store Storage) {
+	t.Helper()
+	for _, bucketName := range []string{"contract", "empty"} {
+		if err := store.CreateBucket(bucketName); err != nil {
+			t.Fatalf("CreateBucket %s: %v", bucketName, err)
+		}
+	}
+	for _, key := range contractObjects {
+		if _, err := store.PutObject("contract", key, strings.NewReader("data-"+key), PutOptions{}); err != nil {
+			t.Fatalf("PutObject %s: %v", key, err)
+		}
+	}
+}
+
+func matchErr(err, want error) bool {
+	if want != errInvalid {
+		return errors.Is(err, want)
+	}
+	var bucketNameError *InvalidBucketNameError
+	var keyError *InvalidKeyError
+	return errors.As(err, &bucketNameError) || errors.As(err, &keyError)
+}
+
+func listKeys(objects []ObjectInfo, err error) (string, error) {
+	keys := make([]string, len(objects))
+	for i, object := range objects {
+		keys[i] = object.Key
+	}
+	return strings.Join(keys, " "), err
+}
+
+func md5Hex(data string) string {
+	sum := md5.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func md5Base64(data string) string {
+	sum := md5.Sum([]byte(data))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
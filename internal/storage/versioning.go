@@ -0,0 +1,451 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// the versioning status of a bucket is kept in the fifth column of its record:
+// empty for buckets which never had versioning enabled, "Enabled" or "Suspended".
+// Versions which are no longer current and delete markers are kept as noncurrent
+// version records with the columns of the object records, where the sixth column
+// holds the version id (empty for the null version) and the seventh one flags
+// delete markers. The null version is stored at the plain object path while
+// the data of every other version lives in .versions/<escaped key>/.<versionId>
+const versionsDir = ".versions"
+
+const (
+	versioningColumn   = 4
+	versionIDColumn    = 5
+	deleteMarkerColumn = 6
+	metadataColumn     = 7
+	encryptionColumn   = 8
+	compressionColumn  = 9
+	storedSizeColumn   = 10
+	blobColumn         = 11
+)
+
+func (s *FileStorage) SetVersioning(bucketName, status string) error {
+	lock := s.bucketLock(bucketName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := s.findBucket(bucketName); err != nil {
+		return err
+	}
+
+	return s.updateBucket(bucketName, func(record []string) []string {
+		for len(record) <= versioningColumn {
+			record = append(record, "")
+		}
+		record[versioningColumn] = status
+		return record
+	})
+}
+
+func (s *FileStorage) ListObjectVersions(bucketName string) ([]ObjectInfo, error) {
+	return s.ListObjectVersionsPage(bucketName, "", "", "", math.MaxInt)
+}
+
+// ListObjectVersionsPage reads the keys from the index a batch at a time and the versions
+// of one key at a time, so that a page costs no more than the versions it lists
+func (s *FileStorage) ListObjectVersionsPage(bucketName, prefix, keyMarker, versionIDMarker string, limit int) ([]ObjectInfo, error) {
+	lock := s.bucketLock(bucketName)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if _, err := s.findBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	// the versions of the marker key up to the marker version were listed on the previous page
+	var versions []ObjectInfo
+	if versionIDMarker != "" && strings.HasPrefix(keyMarker, prefix) {
+		keyVersions := s.keyVersionInfos(bucketName, keyMarker)
+		for i, version := range keyVersions {
+			if DisplayVersionID(version.VersionID) == versionIDMarker {
+				keyVersions = keyVersions[i+1:]
+				break
+			}
+		}
+		versions = append(versions, keyVersions...)
+	}
+
+	after := keyMarker
+	for len(versions) < limit {
+		keys, done := s.nextKeys(bucketName, prefix, after, limit-len(versions))
+		for _, key := range keys {
+			versions = append(versions, s.keyVersionInfos(bucketName, key)...)
+			if len(versions) >= limit {
+				break
+			}
+		}
+		if done || len(keys) == 0 {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	if len(versions) > limit {
+		versions = versions[:limit]
+	}
+	return versions, nil
+}
+
+// keyVersionInfos returns the current version of an object followed by its noncurrent
+// versions from the newest one, the newest version being the latest one
+func (s *FileStorage) keyVersionInfos(bucketName, objectKey string) []ObjectInfo {
+	objectsRecords, versionRecords := s.readKeyVersions(bucketName, objectKey)
+	var versions []ObjectInfo
+	for _, record := range objectsRecords {
+		versions = append(versions, objectInfo(record))
+	}
+	for i := len(versionRecords) - 1; i >= 0; i-- {
+		versions = append(versions, objectInfo(versionRecords[i]))
+	}
+	if len(versions) > 0 {
+		versions[0].IsLatest = true
+	}
+	return versions
+}
+
+// findObject returns the record of the current version of an object, or of the version
+// with the given id as reported to clients, failing if it is a delete marker
+func (s *FileStorage) findObject(bucketName, objectKey, displayedID string) ([]string, error) {
+	if _, err := s.findBucket(bucketName); err != nil {
+		return nil, err
+	}
+	objectsRecords, versionRecords := s.readKeyVersions(bucketName, objectKey)
+
+	if displayedID == "" {
+		if record := findRecord(objectsRecords, objectKey, ""); record != nil {
+			return record, nil
+		}
+		return nil, ErrNoSuchKey
+	}
+
+	record := findRecord(append(objectsRecords, versionRecords...), objectKey, displayedID)
+	if record == nil {
+		return nil, ErrNoSuchVersion
+	} else if isDeleteMarker(record) {
+		return nil, ErrDeleteMarker
+	}
+	return record, nil
+}
+
+// findRecord returns the first record of an object with the given version id as
+// reported to clients, or the first record of the object if displayedID is empty
+func findRecord(records [][]string, objectKey, displayedID string) []string {
+	for _, record := range records {
+		if record[0] == objectKey && (displayedID == "" || DisplayVersionID(versionID(record)) == displayedID) {
+			return record
+		}
+	}
+	return nil
+}
+
+// newVersionPath returns the version id and the path of the file a new version of
+// an object is written to, only buckets with versioning enabled give versions an id
+func (s *FileStorage) newVersionPath(bucketRecord []string, objectKey string) (string, string, error) {
+	if bucketVersioning(bucketRecord) != VersioningEnabled {
+		filePath, err := objectPath(s.dir, bucketRecord[0], objectKey)
+		return "", filePath, err
+	}
+
+	id, err := newVersionID()
+	if err != nil {
+		return "", "", err
+	}
+	filePath, err := versionPath(s.dir, bucketRecord[0], objectKey, id)
+	return id, filePath, err
+}
+
+// applyDelete deletes an object or one of its versions from the given records of a bucket
+// and returns the updated records together with what was deleted. The files which are
+// no longer referenced are added to obsolete, to be removed once the records are written
+func (s *FileStorage) applyDelete(bucketRecord []string, objectKey, displayedID string, objectsRecords, versionRecords [][]string, obsolete *[]string) ([][]string, [][]string, ObjectInfo, error) {
+	bucketName := bucketRecord[0]
+
+	if displayedID != "" {
+		objectsRecords, versionRecords, deleted, err := s.applyVersionDelete(bucketName, objectKey, displayedID, objectsRecords, versionRecords, obsolete)
+		if err != nil {
+			return nil, nil, ObjectInfo{}, err
+		}
+		return objectsRecords, versionRecords, objectInfo(deleted), nil
+	}
+
+	if status := bucketVersioning(bucketRecord); status != "" {
+		objectsRecords, versionRecords, markerID, err := s.applyVersionedDelete(bucketName, objectKey, status, objectsRecords, versionRecords, obsolete)
+		if err != nil {
+			return nil, nil, ObjectInfo{}, err
+		}
+		return objectsRecords, versionRecords, ObjectInfo{Key: objectKey, VersionID: markerID, DeleteMarker: true}, nil
+	}
+
+	objectsRecords, err := s.applyObjectDelete(bucketName, objectKey, objectsRecords, obsolete)
+	if err != nil {
+		return nil, nil, ObjectInfo{}, err
+	}
+	return objectsRecords, versionRecords, ObjectInfo{Key: objectKey}, nil
+}
+
+// applyObjectDelete removes an object of a bucket without versioning from the given
+// records and marks its file obsolete, deleting a key which does not exist succeeds
+func (s *FileStorage) applyObjectDelete(bucketName, objectKey string, objectsRecords [][]string, obsolete *[]string) ([][]string, error) {
+	var newObjectRecords [][]string
+	found := false
+	for _, record := range objectsRecords {
+		if record[0] == objectKey {
+			found = true
+		} else {
+			newObjectRecords = append(newObjectRecords, record)
+		}
+	}
+	if !found {
+		return objectsRecords, nil
+	}
+
+	filePath, err := objectPath(s.dir, bucketName, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	*obsolete = append(*obsolete, filePath)
+	return newObjectRecords, nil
+}
+
+// applyVersionedDelete puts a delete marker on top of an object in the given records,
+// the marker replaces the null version of the object if versioning is suspended.
+// It returns the updated records and the version id of the marker
+func (s *FileStorage) applyVersionedDelete(bucketName, objectKey, status string, objectsRecords, versionRecords [][]string, obsolete *[]string) ([][]string, [][]string, string, error) {
+	markerID := ""
+	if status == VersioningEnabled {
+		id, err := newVersionID()
+		if err != nil {
+			return nil, nil, "", err
+		}
+		markerID = id
+	}
+
+	// the current version becomes a noncurrent one, unless the marker replaces it as the null version
+	var newObjectRecords [][]string
+	hasNullVersion := false
+	for _, record := range objectsRecords {
+		if record[0] != objectKey {
+			newObjectRecords = append(newObjectRecords, record)
+		} else if markerID == "" && versionID(record) == "" {
+			hasNullVersion = true
+		} else {
+			versionRecords = append(versionRecords, versionRecord(record, false))
+		}
+	}
+
+	var newVersionRecords [][]string
+	for _, record := range versionRecords {
+		if markerID == "" && record[0] == objectKey && versionID(record) == "" {
+			hasNullVersion = hasNullVersion || !isDeleteMarker(record)
+			continue
+		}
+		newVersionRecords = append(newVersionRecords, record)
+	}
+	marker := versionRecord([]string{objectKey, "0", "", time.Now().Format(time.RFC850), "", markerID, ""}, true)
+	newVersionRecords = append(newVersionRecords, marker)
+
+	if hasNullVersion {
+		filePath, err := objectPath(s.dir, bucketName, objectKey)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		*obsolete = append(*obsolete, filePath)
+	}
+
+	return newObjectRecords, newVersionRecords, markerID, nil
+}
+
+// applyVersionDelete removes a version of an object, or a delete marker, from the given records,
+// marks its data obsolete and promotes the newest remaining version when the object was left
+// without a current one. It returns the updated records and the record of the deleted version
+func (s *FileStorage) applyVersionDelete(bucketName, objectKey, displayedID string, objectsRecords, versionRecords [][]string, obsolete *[]string) ([][]string, [][]string, []string, error) {
+	var deleted []string
+	var newObjectRecords, newVersionRecords [][]string
+	for _, record := range objectsRecords {
+		if deleted == nil && record[0] == objectKey && DisplayVersionID(versionID(record)) == displayedID {
+			deleted = record
+		} else {
+			newObjectRecords = append(newObjectRecords, record)
+		}
+	}
+	for _, record := range versionRecords {
+		if deleted == nil && record[0] == objectKey && DisplayVersionID(versionID(record)) == displayedID {
+			deleted = record
+		} else {
+			newVersionRecords = append(newVersionRecords, record)
+		}
+	}
+	if deleted == nil {
+		return nil, nil, nil, ErrNoSuchVersion
+	}
+
+	// a blob is removed with its last reference instead
+	if !isDeleteMarker(deleted) && recordBlob(deleted) == "" {
+		filePath, err := recordPath(s.dir, bucketName, deleted)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		*obsolete = append(*obsolete, filePath)
+	}
+
+	current := false
+	for _, record := range newObjectRecords {
+		current = current || record[0] == objectKey
+	}
+	if !current {
+		for i := len(newVersionRecords) - 1; i >= 0; i-- {
+			if newVersionRecords[i][0] != objectKey {
+				continue
+			}
+			if !isDeleteMarker(newVersionRecords[i]) {
+				newObjectRecords = append(newObjectRecords, versionRecord(newVersionRecords[i], false))
+				newVersionRecords = append(newVersionRecords[:i], newVersionRecords[i+1:]...)
+			}
+			break
+		}
+	}
+
+	return newObjectRecords, newVersionRecords, deleted, nil
+}
+
+// readKeyVersions returns the record of the current version of an object, as a list of
+// at most one record, and the records of its noncurrent versions from the oldest one
+func (s *FileStorage) readKeyVersions(bucketName, objectKey string) ([][]string, [][]string) {
+	var objectsRecords, versionRecords [][]string
+	if record, found := s.meta.get(objectIndexPrefix(bucketName) + objectKey); found {
+		objectsRecords = append(objectsRecords, record)
+	}
+	s.meta.ascend(versionIndexPrefix(bucketName)+objectKey+"\x00", func(_ string, record []string) bool {
+		versionRecords = append(versionRecords, slices.Clone(record))
+		return true
+	})
+	return objectsRecords, versionRecords
+}
+
+// keyVersionOps returns the updates replacing the records of an object with the given ones.
+// The noncurrent versions are stored by their position, so that only those after the
+// longest unchanged run of the oldest versions are written again: appending a version
+// or deleting the newest ones costs a single update each
+func (s *FileStorage) keyVersionOps(bucketName, objectKey string, objectsRecords, versionRecords [][]string) []metaOp {
+	var ops []metaOp
+	objectKeyPath := objectIndexPrefix(bucketName) + objectKey
+	current, found := s.meta.get(objectKeyPath)
+	if len(objectsRecords) > 0 && !slices.Equal(current, objectsRecords[0]) {
+		ops = append(ops, metaOp{objectKeyPath, objectsRecords[0]})
+	} else if len(objectsRecords) == 0 && found {
+		ops = append(ops, metaOp{key: objectKeyPath})
+	}
+
+	position := 0
+	s.meta.ascend(versionIndexPrefix(bucketName)+objectKey+"\x00", func(key string, record []string) bool {
+		if position == len(versionRecords) || !slices.Equal(record, versionRecords[position]) || key != versionIndexKey(bucketName, objectKey, position) {
+			ops = append(ops, metaOp{key: key})
+			return true
+		}
+		position++
+		return true
+	})
+	for i := position; i < len(versionRecords); i++ {
+		ops = append(ops, metaOp{versionIndexKey(bucketName, objectKey, i), versionRecords[i]})
+	}
+	return ops
+}
+
+// archiveVersion records the replaced current version of an object as its newest noncurrent
+// one, a new null version replaces the noncurrent null version of the object if there is one
+func archiveVersion(versionRecords [][]string, replaced []string, newVersionID string) [][]string {
+	var newVersionRecords [][]string
+	for _, record := range versionRecords {
+		if newVersionID == "" && versionID(record) == "" {
+			continue
+		}
+		newVersionRecords = append(newVersionRecords, record)
+	}
+	if replaced != nil {
+		newVersionRecords = append(newVersionRecords, versionRecord(replaced, false))
+	}
+	return newVersionRecords
+}
+
+// bucketVersioning returns the versioning status kept in a bucket record
+func bucketVersioning(bucketRecord []string) string {
+	if len(bucketRecord) <= versioningColumn {
+		return ""
+	}
+	return bucketRecord[versioningColumn]
+}
+
+// recordPath returns the path of the file holding the data of an object version
+func recordPath(dir, bucketName string, record []string) (string, error) {
+	if hash := recordBlob(record); hash != "" {
+		return blobPath(dir, hash), nil
+	}
+	if id := versionID(record); id != "" {
+		return versionPath(dir, bucketName, record[0], id)
+	}
+	return objectPath(dir, bucketName, record[0])
+}
+
+// versionPath maps an object version to its file under the .versions directory in the
+// directory of its key, the escaped key segments never start with a dot so the file cannot
+// clash with them
+func versionPath(dir, bucketName, objectKey, versionID string) (string, error) {
+	keyPath, err := keyPath(dir, bucketName+"/"+versionsDir, objectKey)
+	if err != nil {
+		return "", err
+	}
+	return keyPath + "/." + versionID, nil
+}
+
+// versionsPath returns the path of the versions.csv kept by older versions, read by importCSV
+func versionsPath(dir, bucketName string) string {
+	return dir + "/" + bucketName + "/" + versionsDir + "/versions.csv"
+}
+
+// versionRecord returns a copy of an object record flagged as a delete marker or not
+func versionRecord(record []string, deleteMarker bool) []string {
+	row := make([]string, max(len(record), deleteMarkerColumn+1))
+	copy(row, record)
+	row[deleteMarkerColumn] = ""
+	if deleteMarker {
+		row[deleteMarkerColumn] = "True"
+	}
+	return row
+}
+
+func versionID(record []string) string {
+	if len(record) <= versionIDColumn {
+		return ""
+	}
+	return record[versionIDColumn]
+}
+
+func isDeleteMarker(record []string) bool {
+	return len(record) > deleteMarkerColumn && record[deleteMarkerColumn] == "True"
+}
+
+// DisplayVersionID returns the version id reported to clients, "null" for the null version
+func DisplayVersionID(id string) string {
+	if id == "" {
+		return "null"
+	}
+	return id
+}
+
+func newVersionID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestListObjectVersionsPages(t *testing.T) {
+	store := testFileStorage(t)
+	if err := store.CreateBucket("versions"); err != nil {
+		t.Fatalf("CreateBucket: %v", err)
+	}
+	if _, err := store.PutObject("versions", "null", strings.NewReader("null version"), PutOptions{}); err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+	if err := store.SetVersioning("versions", VersioningEnabled); err != nil {
+		t.Fatalf("SetVersioning: %v", err)
+	}
+	for i, key := range []string{"a", "a/b", "b", "null", "c/d", "a", "c/d", "b"} {
+		if _, err := store.PutObject("versions", key, strings.NewReader(fmt.Sprint(i)), PutOptions{}); err != nil {
+			t.Fatalf("PutObject: %v", err)
+		}
+	}
+	for _, key := range []string{"b", "c/d", "c/d"} {
+		if _, err := store.DeleteObject("versions", key, ""); err != nil {
+			t.Fatalf("DeleteObject: %v", err)
+		}
+	}
+
+	all, err := store.ListObjectVersions("versions")
+	if err != nil {
+		t.Fatalf("ListObjectVersions: %v", err)
+	}
+	for _, prefix := range []string{"", "a", "c/", "missing"} {
+		var want []ObjectInfo
+		for _, version := range all {
+			if strings.HasPrefix(version.Key, prefix) {
+				want = append(want, version)
+			}
+		}
+
+		// reading the pages from after the last version of every page lists every version once
+		for limit := 1; limit <= len(all)+1; limit++ {
+			var got []ObjectInfo
+			keyMarker, versionIDMarker := "", ""
+			for {
+				page, err := store.ListObjectVersionsPage("versions", prefix, keyMarker, versionIDMarker, limit)
+				if err != nil {
+					t.Fatalf("ListObjectVersionsPage: %v", err)
+				}
+				got = append(got, page...)
+				if len(page) < limit {
+					break
+				}
+				last := page[len(page)-1]
+				keyMarker, versionIDMarker = last.Key, DisplayVersionID(last.VersionID)
+			}
+			if !slices.EqualFunc(got, want, sameVersion) {
+				t.Errorf("prefix %q, pages of %d: got %v, want %v", prefix, limit, versionNames(got), versionNames(want))
+			}
+		}
+	}
+}
+
+func sameVersion(a, b ObjectInfo) bool {
+	return a.Key == b.Key && a.VersionID == b.VersionID && a.IsLatest == b.IsLatest && a.DeleteMarker == b.DeleteMarker
+}
+
+func versionNames(versions []ObjectInfo) []string {
+	names := make([]string, len(versions))
+	for i, version := range versions {
+		names[i] = version.Key + "@" + DisplayVersionID(version.VersionID)
+	}
+	return names
+}
@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"triple-s/internal/storage"
+	"triple-s/utils"
+)
+
+// maxConfigurationSize bounds the body of the requests setting a bucket configuration
+// document of a few elements, such as its versioning status
+const maxConfigurationSize = 64 << 10
+
+type VersioningConfiguration struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	Status  string   `xml:",omitempty"`
+}
+
+type ListVersionsResult struct {
+	XMLName             xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListVersionsResult"`
+	Name                string
+	Prefix              string
+	KeyMarker           string
+	VersionIdMarker     string
+	NextKeyMarker       string `xml:",omitempty"`
+	NextVersionIdMarker string `xml:",omitempty"`
+	MaxKeys             int
+	Delimiter           string `xml:",omitempty"`
+	IsTruncated         bool
+	Versions            []ListedVersion
+	CommonPrefixes      []CommonPrefix
+}
+
+// ListedVersion is listed as a Version or, for delete markers, a DeleteMarker element
+type ListedVersion struct {
+	XMLName      xml.Name
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	LastModified string
+	ETag         string `xml:",omitempty"`
+	Size         *int64 `xml:",omitempty"`
+	StorageClass string `xml:",omitempty"`
+}
+
+func PutBucketVersioning(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+
+	versioningStore, ok := store.(storage.VersioningStorage)
+	if !ok {
+		utils.DisplayErrorWoErr(w, utils.ErrNotImplemented, "Versioning is not supported by the storage")
+		return
+	}
+	if _, err := store.StatBucket(bucketName); err != nil {
+		displayStorageError(w, err, "Failed to read the bucket: ")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxConfigurationSize))
+	if err != nil {
+		displayStorageError(w, err, "Failed to read the request body: ")
+		return
+	}
+
+	var configuration VersioningConfiguration
+	err = xml.Unmarshal(body, &configuration)
+	if err != nil || (configuration.Status != storage.VersioningEnabled && configuration.Status != storage.VersioningSuspended) {
+		utils.DisplayErrorWoErr(w, utils.ErrMalformedXML, "")
+		return
+	}
+
+	err = versioningStore.SetVersioning(bucketName, configuration.Status)
+	if err != nil {
+		displayStorageError(w, err, "Failed to set the versioning status: ")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetBucketVersioning(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+
+	bucket, err := store.StatBucket(bucketName)
+	if err != nil {
+		displayStorageError(w, err, "Failed to read the bucket: ")
+		return
+	}
+
+	utils.DisplayXML(w, http.StatusOK, VersioningConfiguration{
+		Xmlns:  "http://s3.amazonaws.com/doc/2006-03-01/",
+		Status: bucket.Versioning,
+	})
+}
+
+func ListObjectVersions(w http.ResponseWriter, req *http.Request, store storage.Storage) {
+	bucketName := req.PathValue("BucketName")
+	query := req.URL.Query()
+
+	maxKeys := 1000
+	if query.Has("max-keys") {
+		value, err := strconv.Atoi(query.Get("max-keys"))
+		if err != nil || value < 0 {
+			utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, "max-keys must be a non-negative integer")
+			return
+		}
+		maxKeys = min(value, 1000)
+	}
+
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	keyMarker := query.Get("key-marker")
+	versionIDMarker := query.Get("version-id-marker")
+	if versionIDMarker != "" && keyMarker == "" {
+		utils.DisplayErrorWoErr(w, utils.ErrInvalidArgument, "A version-id marker cannot be specified without a key marker")
+		return
+	}
+
+	result := ListVersionsResult{
+		Name:            bucketName,
+		Prefix:          prefix,
+		KeyMarker:       keyMarker,
+		VersionIdMarker: versionIDMarker,
+		MaxKeys:         maxKeys,
+		Delimiter:       delimiter,
+	}
+
+	// the versions are read a page at a time from after the markers, once a common prefix is
+	// listed the page is read again from after every key starting with it, as for ListObjectsV2
+	count := 0
+	afterKey, afterVersionID := keyMarker, versionIDMarker
+	for done := false; !done; {
+		limit := maxKeys - count + 1
+		versions, err := listVersionsPage(store, bucketName, prefix, afterKey, afterVersionID, limit)
+		if err != nil {
+			displayStorageError(w, err, "Failed to list the object versions: ")
+			return
+		}
+		done = len(versions) < limit
+
+		for _, version := range versions {
+			key := version.Key
+			afterKey, afterVersionID = key, storage.DisplayVersionID(version.VersionID)
+
+			commonPrefix := ""
+			if delimiter != "" {
+				if idx := strings.Index(key[len(prefix):], delimiter); idx >= 0 {
+					commonPrefix = key[:len(prefix)+idx+len(delimiter)]
+				}
+			}
+			if commonPrefix != "" && strings.HasPrefix(keyMarker, commonPrefix) {
+				afterKey, afterVersionID, done = commonPrefix+"\xff", "", false
+				break
+			}
+
+			if count == maxKeys {
+				result.IsTruncated = maxKeys > 0
+				done = true
+				break
+			}
+
+			count++
+			if commonPrefix != "" {
+				result.CommonPrefixes = append(result.CommonPrefixes, CommonPrefix{Prefix: commonPrefix})
+				result.NextKeyMarker, result.NextVersionIdMarker = commonPrefix, ""
+				afterKey, afterVersionID, done = commonPrefix+"\xff", "", false
+				break
+			}
+			result.Versions = append(result.Versions, listedVersion(version))
+			result.NextKeyMarker, result.NextVersionIdMarker = key, storage.DisplayVersionID(version.VersionID)
+		}
+	}
+
+	if !result.IsTruncated {
+		result.NextKeyMarker, result.NextVersionIdMarker = "", ""
+	}
+
+	utils.DisplayXML(w, http.StatusOK, result)
+}
+
+// listVersionsPage returns a page of the versions of a bucket, a storage without versioning
+// only has the current version of every object, whose id is "null"
+func listVersionsPage(store storage.Storage, bucketName, prefix, keyMarker, versionIDMarker string, limit int) ([]storage.ObjectInfo, error) {
+	if versioningStore, ok := store.(storage.VersioningStorage); ok {
+		return versioningStore.ListObjectVersionsPage(bucketName, prefix, keyMarker, versionIDMarker, limit)
+	}
+	objects, err := store.ListObjectsPage(bucketName, prefix, keyMarker, limit)
+	if err != nil {
+		return nil, err
+	}
+	// a version marker other than "null" leaves the version of the marker key to be listed
+	if versionIDMarker != "" && versionIDMarker != "null" && strings.HasPrefix(keyMarker, prefix) {
+		if info, err := store.StatObject(bucketName, keyMarker, ""); err == nil {
+			objects = append([]storage.ObjectInfo{info}, objects...)[:min(len(objects)+1, limit)]
+		}
+	}
+	for i := range objects {
+		objects[i].IsLatest = true
+	}
+	return objects, nil
+}
+
+func listedVersion(info storage.ObjectInfo) ListedVersion {
+	version := ListedVersion{
+		XMLName:      xml.Name{Space: "http://s3.amazonaws.com/doc/2006-03-01/", Local: "Version"},
+		Key:          info.Key,
+		VersionId:    storage.DisplayVersionID(info.VersionID),
+		IsLatest:     info.IsLatest,
+		LastModified: s3Time(info.LastModified),
+	}
+	if info.DeleteMarker {
+		version.XMLName.Local = "DeleteMarker"
+		return version
+	}
+	size := info.Size
+	version.ETag = objectETag(info)
+	version.Size = &size
+	version.StorageClass = "STANDARD"
+	return version
+}
+
+// requestVersionID returns the version id asked for by the versionId query parameter,
+// empty for the current version. An empty versionId names no version at all
+func requestVersionID(req *http.Request) (string, error) {
+	query := req.URL.Query()
+	if query.Has("versionId") && query.Get("versionId") == "" {
+		return "", storage.ErrNoSuchVersion
+	}
+	return query.Get("versionId"), nil
+}
+
+// setDeleteMarkerHeaders flags the response to a request for a version which is a delete marker
+func setDeleteMarkerHeaders(w http.ResponseWriter, err error, versionID string) {
+	if errors.Is(err, storage.ErrDeleteMarker) {
+		w.Header().Set("x-amz-delete-marker", "true")
+		w.Header().Set("x-amz-version-id", versionID)
+	}
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"os"
+
 	ts "triple-s/cmd/triple-s"
 )
 
 func main() {
 	// fmt.Println("Main was started")
+	if len(os.Args) > 1 && os.Args[1] == "presign" {
+		ts.Presign(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		ts.Fsck(os.Args[2:])
+		return
+	}
 	ts.Run()
 }
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+)
+
+// APIError is an entry of the catalogue of S3 error codes with the HTTP status it is sent with
+type APIError struct {
+	Code        string
+	StatusCode  int
+	Description string
+}
+
+var (
+	ErrAccessDenied                      = APIError{"AccessDenied", http.StatusForbidden, "Access Denied"}
+	ErrAuthorizationHeaderMalformed      = APIError{"AuthorizationHeaderMalformed", http.StatusBadRequest, "The authorization header you provided is invalid"}
+	ErrAuthorizationQueryParametersError = APIError{"AuthorizationQueryParametersError", http.StatusBadRequest, "The authorization query parameters you provided are invalid"}
+	ErrBadDigest                         = APIError{"BadDigest", http.StatusBadRequest, "The Content-MD5 you specified did not match what was received"}
+	ErrBucketAlreadyExists               = APIError{"BucketAlreadyExists", http.StatusConflict, "The requested bucket name is not available"}
+	ErrBucketNotEmpty                    = APIError{"BucketNotEmpty", http.StatusConflict, "The bucket you tried to delete is not empty"}
+	ErrContentSHA256Mismatch             = APIError{"XAmzContentSHA256Mismatch", http.StatusBadRequest, "The provided 'x-amz-content-sha256' header does not match what was computed"}
+	ErrCustomerKeyMismatch               = APIError{"AccessDenied", http.StatusForbidden, "The provided customer key does not match the key the object was encrypted with"}
+	ErrCustomerKeyRequired               = APIError{"InvalidRequest", http.StatusBadRequest, "The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object"}
+	ErrEncryptionConflict                = APIError{"InvalidArgument", http.StatusBadRequest, "Server Side Encryption with Customer provided key is incompatible with the encryption method specified"}
+	ErrEncryptionKeyMD5Mismatch          = APIError{"InvalidArgument", http.StatusBadRequest, "The calculated MD5 hash of the key did not match the hash that was provided"}
+	ErrEntityTooLarge                    = APIError{"EntityTooLarge", http.StatusBadRequest, "Your proposed upload exceeds the maximum allowed object size"}
+	ErrEntityTooSmall                    = APIError{"EntityTooSmall", http.StatusBadRequest, "Your proposed upload is smaller than the minimum allowed object size"}
+	ErrIncompleteBody                    = APIError{"IncompleteBody", http.StatusBadRequest, "You did not provide the number of bytes specified by the Content-Length HTTP header"}
+	ErrInternalError                     = APIError{"InternalError", http.StatusInternalServerError, "We encountered an internal error. Please try again"}
+	ErrInvalidAccessKeyId                = APIError{"InvalidAccessKeyId", http.StatusForbidden, "The AWS access key ID you provided does not exist in our records"}
+	ErrInvalidArgument                   = APIError{"InvalidArgument", http.StatusBadRequest, "Invalid Argument"}
+	ErrInvalidBucketName                 = APIError{"InvalidBucketName", http.StatusBadRequest, "The specified bucket is not valid"}
+	ErrInvalidDigest                     = APIError{"InvalidDigest", http.StatusBadRequest, "The Content-MD5 you specified is not valid"}
+	ErrInvalidEncryptionAlgorithm        = APIError{"InvalidEncryptionAlgorithmError", http.StatusBadRequest, "The encryption request you specified is not valid. The valid value is AES256"}
+	ErrInvalidEncryptionKey              = APIError{"InvalidArgument", http.StatusBadRequest, "The secret key was invalid for the specified algorithm"}
+	ErrInvalidPart                       = APIError{"InvalidPart", http.StatusBadRequest, "One or more of the specified parts could not be found"}
+	ErrInvalidPartOrder                  = APIError{"InvalidPartOrder", http.StatusBadRequest, "The list of parts was not in ascending order"}
+	ErrInvalidRange                      = APIError{"InvalidRange", http.StatusRequestedRangeNotSatisfiable, "The requested range is not satisfiable"}
+	ErrInvalidRequest                    = APIError{"InvalidRequest", http.StatusBadRequest, "Invalid Request"}
+	ErrKeyTooLong                        = APIError{"KeyTooLongError", http.StatusBadRequest, "Your key is too long"}
+	ErrMalformedXML                      = APIError{"MalformedXML", http.StatusBadRequest, "The XML you provided was not well-formed or did not validate against our published schema"}
+	ErrMetadataTooLarge                  = APIError{"MetadataTooLarge", http.StatusBadRequest, "Your metadata headers exceed the maximum allowed metadata size"}
+	ErrMethodNotAllowed                  = APIError{"MethodNotAllowed", http.StatusMethodNotAllowed, "The specified method is not allowed against this resource"}
+	ErrMissingContentLength              = APIError{"MissingContentLength", http.StatusLengthRequired, "You must provide the Content-Length HTTP header"}
+	ErrNoSuchBucket                      = APIError{"NoSuchBucket", http.StatusNotFound, "The specified bucket does not exist"}
+	ErrNoSuchKey                         = APIError{"NoSuchKey", http.StatusNotFound, "The specified key does not exist"}
+	ErrNoSuchLifecycleConfiguration      = APIError{"NoSuchLifecycleConfiguration", http.StatusNotFound, "The lifecycle configuration does not exist"}
+	ErrNoSuchUpload                      = APIError{"NoSuchUpload", http.StatusNotFound, "The specified multipart upload does not exist"}
+	ErrNoSuchVersion                     = APIError{"NoSuchVersion", http.StatusNotFound, "The specified version does not exist"}
+	ErrNotImplemented                    = APIError{"NotImplemented", http.StatusNotImplemented, "A header you provided implies functionality that is not implemented"}
+	ErrPreconditionFailed                = APIError{"PreconditionFailed", http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold"}
+	ErrQuotaExceeded                     = APIError{"QuotaExceeded", http.StatusForbidden, "The bucket quota does not leave room for the upload"}
+	ErrRequestTimeTooSkewed              = APIError{"RequestTimeTooSkewed", http.StatusForbidden, "The difference between the request time and the server's time is too large"}
+	ErrSignatureDoesNotMatch             = APIError{"SignatureDoesNotMatch", http.StatusForbidden, "The request signature we calculated does not match the signature you provided"}
+)
+
+// requestWriter carries the resource of the request being served so that
+// the error responses can report it next to the request id
+type requestWriter struct {
+	http.ResponseWriter
+	resource string
+}
+
+func (rw *requestWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// ReadFrom keeps the sendfile optimisation of the wrapped writer for io.Copy
+func (rw *requestWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(rw.ResponseWriter, r)
+}
+
+// WithRequestID assigns every request an id, echoed in the x-amz-request-id header
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := make([]byte, 8)
+		rand.Read(id)
+		w.Header().Set("x-amz-request-id", hex.EncodeToString(id))
+		next.ServeHTTP(&requestWriter{ResponseWriter: w, resource: req.URL.Path}, req)
+	})
+}